@@ -1,13 +1,17 @@
 package afs
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 
 	"google.golang.org/api/drive/v3"
 )
@@ -24,7 +28,10 @@ type Node struct {
 	name       string // Just of this directory/node
 	isDir      bool
 	driveID    string // ID corresponding to file in Google Drive
-	md5sum     string // md5sum if it is a file, empty otherwise
+	checksum   string // checksum if it is a file, empty otherwise
+	meta       Metadata
+	hash       string // Merkle hash if it is a directory, empty otherwise
+	hashValid  bool   // If false, hash must be recomputed (and so must those of all ancestors)
 	children   map[string]*Node
 	parentNode *Node
 }
@@ -33,6 +40,7 @@ type Node struct {
 type Tree struct {
 	name string
 	root *Node
+	algo HashAlgorithm // Used for the checksums of the files
 }
 
 func newNode(name string, isDir bool, parentPtr *Node) *Node {
@@ -42,7 +50,7 @@ func newNode(name string, isDir bool, parentPtr *Node) *Node {
 		children:   make(map[string]*Node),
 		parentNode: parentPtr,
 		driveID:    "",
-		md5sum:     "",
+		checksum:   "",
 	}
 }
 
@@ -71,14 +79,63 @@ func (node *Node) SetDriveID(id string) {
 	node.driveID = id
 }
 
-// Checksum returns the MD5 of the node
+// Checksum returns the checksum of the node, computed by the hash algorithm of its tree
 func (node *Node) Checksum() string {
-	return node.md5sum
+	return node.checksum
 }
 
 // SetChecksum sets the checksum for the node
 func (node *Node) SetChecksum(checksum string) {
-	node.md5sum = checksum
+	node.checksum = checksum
+	node.invalidateHash()
+}
+
+// Metadata returns the file system attributes of the node
+func (node *Node) Metadata() Metadata {
+	return node.meta
+}
+
+// SetMetadata sets the file system attributes of the node
+func (node *Node) SetMetadata(meta Metadata) {
+	node.meta = meta
+}
+
+// Hash returns the Merkle hash of the node.
+// For a file this is just its checksum. For a directory, it is derived from
+// the names, types and hashes of its children, so two directories have the
+// same hash iff their subtrees are identical (ignoring the names of the directories themselves).
+// Only the hashes invalidated since the last call are recomputed.
+func (node *Node) Hash() string {
+	if !node.isDir {
+		return node.checksum
+	}
+	if node.hashValid {
+		return node.hash
+	}
+	names := make([]string, 0, len(node.children))
+	for name := range node.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sum := sha256.New()
+	for _, name := range names {
+		child := node.children[name]
+		kind := "f"
+		if child.isDir {
+			kind = "d"
+		}
+		fmt.Fprintf(sum, "%s\x00%s\x00%s\n", name, kind, child.Hash())
+	}
+	node.hash = hex.EncodeToString(sum.Sum(nil))
+	node.hashValid = true
+	return node.hash
+}
+
+// Marks the hash of this node and all its ancestors as stale
+func (node *Node) invalidateHash() {
+	for curr := node; curr != nil && (curr.hashValid || curr == node); curr = curr.parentNode {
+		curr.hashValid = false
+	}
 }
 
 func (node *Node) String() string {
@@ -90,8 +147,8 @@ func (node *Node) String() string {
 	if node.isDir {
 		fmt.Fprint(&b, " d")
 	} else {
-		if node.md5sum != "" {
-			fmt.Fprintf(&b, " => %s", node.md5sum)
+		if node.checksum != "" {
+			fmt.Fprintf(&b, " => %s", node.checksum)
 		}
 	}
 	return b.String()
@@ -113,26 +170,38 @@ func NewTree(dir string) *Tree {
 	return &Tree{
 		name: parent,
 		root: rootNode,
+		algo: MD5,
 	}
 }
 
 // NewTreeFromDrive reconstructs the tree from the list of files
-// retrieved from Google Drive
-func NewTreeFromDrive(files []*drive.File, rootPath string) (*Tree, error) {
+// retrieved from Google Drive, with checksums computed by algo
+func NewTreeFromDrive(files []*drive.File, rootPath string, algo HashAlgorithm) (*Tree, error) {
 	rootID := ""
 	rootPathParts := SplitPathPlatform(rootPath)
 	rootName := rootPathParts[len(rootPathParts)-1]
-	childrenOf := make(map[string][]*drive.File)
 	for _, file := range files {
 		if rootName == file.Name {
 			rootID = file.Id
 		}
-		parentID := file.Parents[0]
-		childrenOf[parentID] = append(childrenOf[parentID], file)
 	}
 	if rootID == "" {
 		return nil, fmt.Errorf("can't find id for %s", rootPath)
 	}
+	return NewTreeFromDriveFolder(files, rootID, rootName, algo), nil
+}
+
+// NewTreeFromDriveFolder reconstructs the tree rooted at the folder with the given ID and name,
+// from the list of files below it retrieved from Google Drive, with checksums computed by algo
+func NewTreeFromDriveFolder(files []*drive.File, rootID, rootName string, algo HashAlgorithm) *Tree {
+	childrenOf := make(map[string][]*drive.File)
+	for _, file := range files {
+		if len(file.Parents) == 0 {
+			continue
+		}
+		parentID := file.Parents[0]
+		childrenOf[parentID] = append(childrenOf[parentID], file)
+	}
 
 	rootNode := newNode(rootName, true, nil)
 	rootNode.driveID = rootID
@@ -149,8 +218,9 @@ func NewTreeFromDrive(files []*drive.File, rootPath string) (*Tree, error) {
 				childNode := newNode(child.Name, isDir, node)
 				childNode.driveID = child.Id
 				if !isDir {
-					childNode.md5sum = child.AppProperties["md5sum"]
+					childNode.checksum = algo.ChecksumOf(child)
 				}
+				childNode.meta = MetadataFromAppProperties(child.AppProperties)
 				node.children[child.Name] = childNode
 				queue = append(queue, childNode)
 			}
@@ -160,8 +230,20 @@ func NewTreeFromDrive(files []*drive.File, rootPath string) (*Tree, error) {
 	tree := &Tree{
 		name: "",
 		root: rootNode,
+		algo: algo,
 	}
-	return tree, nil
+	return tree
+}
+
+// HashAlgorithm returns the algorithm used for the checksums of the files in the tree
+func (tree *Tree) HashAlgorithm() HashAlgorithm {
+	return tree.algo
+}
+
+// SetHashAlgorithm sets the algorithm used for the checksums of the files in the tree.
+// It must be set before any checksums are calculated.
+func (tree *Tree) SetHashAlgorithm(algo HashAlgorithm) {
+	tree.algo = algo
 }
 
 // Root returns the root node of the tree
@@ -200,7 +282,7 @@ func (tree *Tree) String() string {
 // Returns true if the path was actually added
 func (tree *Tree) AddPath(path string, isDir bool) bool {
 	topPath := tree.RootPath()
-	if !strings.HasPrefix(path, topPath) {
+	if !IsSubPath(path, topPath) {
 		return false
 	}
 	topPathParts := SplitPathPlatform(topPath)
@@ -242,13 +324,14 @@ func (tree *Tree) AddPath(path string, isDir bool) bool {
 		return false
 	}
 	addPath(addNode, remaining)
+	addNode.invalidateHash()
 	return true
 }
 
 // Given a path, searches if it is in the tree
 func (tree *Tree) findPath(path string) (*Node, bool) {
 	topPath := tree.RootPath()
-	if !strings.HasPrefix(path, topPath) {
+	if !IsSubPath(path, topPath) {
 		return nil, false
 	}
 	topPathParts := SplitPathPlatform(topPath)
@@ -281,6 +364,7 @@ func (tree *Tree) DeletePath(path string) bool {
 	}
 	parent := node.parentNode
 	delete(parent.children, node.name)
+	parent.invalidateHash()
 	node = nil
 	return true
 }
@@ -305,7 +389,43 @@ func (tree *Tree) RenamePath(oldPath, newPath string) bool {
 	oldNode.name = newPathParts[len(newPathParts)-1]
 	newPathParentNode.children[oldNode.name] = oldNode
 	oldNode.parentNode = newPathParentNode
+	oldNodeParent.invalidateHash()
+	newPathParentNode.invalidateHash()
+
+	return true
+}
+
+// DetachPath removes the node at path (along with its subtree) from the tree
+// and returns it, so that it can be attached to another tree with AttachNode.
+// The root of the tree cannot be detached.
+func (tree *Tree) DetachPath(path string) (*Node, bool) {
+	node, ok := tree.findPath(path)
+	if !ok || node.parentNode == nil {
+		return nil, false
+	}
+	parent := node.parentNode
+	delete(parent.children, node.name)
+	parent.invalidateHash()
+	node.parentNode = nil
+	return node, true
+}
 
+// AttachNode attaches a node detached by DetachPath at path,
+// renaming it if necessary. The parent of path must be present in the tree.
+func (tree *Tree) AttachNode(path string, node *Node) bool {
+	pathParts := SplitPathPlatform(path)
+	if len(pathParts) == 0 {
+		return false
+	}
+	parentPath := JoinPathPlatform(pathParts[0:len(pathParts)-1], true)
+	parent, ok := tree.findPath(parentPath)
+	if !ok || !parent.isDir {
+		return false
+	}
+	node.name = pathParts[len(pathParts)-1]
+	node.parentNode = parent
+	parent.children[node.name] = node
+	parent.invalidateHash()
 	return true
 }
 
@@ -340,6 +460,16 @@ func (tree *Tree) AttachID(path, id string) bool {
 	return true
 }
 
+// AttachMetadata attaches the file system attributes to a path
+func (tree *Tree) AttachMetadata(path string, meta Metadata) bool {
+	node, ok := tree.findPath(path)
+	if !ok {
+		return false
+	}
+	node.meta = meta
+	return true
+}
+
 // RetrieveID returns the Google Drive id to a path
 func (tree *Tree) RetrieveID(path string) (string, error) {
 	node, ok := tree.findPath(path)
@@ -349,6 +479,39 @@ func (tree *Tree) RetrieveID(path string) (string, error) {
 	return node.driveID, nil
 }
 
+// RetrieveMetadata returns the file system attributes attached to a path
+func (tree *Tree) RetrieveMetadata(path string) (Metadata, error) {
+	node, ok := tree.findPath(path)
+	if !ok {
+		return Metadata{}, errors.New("Path not found: " + path)
+	}
+	return node.meta, nil
+}
+
+// Walk calls walkFn for path and every path below it in the tree,
+// parents before their children and siblings in lexical order.
+// Returns false if path is not in the tree.
+func (tree *Tree) Walk(path string, walkFn func(path string, node *Node)) bool {
+	node, ok := tree.findPath(path)
+	if !ok {
+		return false
+	}
+	var walk func(path string, node *Node)
+	walk = func(path string, node *Node) {
+		walkFn(path, node)
+		names := make([]string, 0, len(node.children))
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			walk(filepath.Join(path, name), node.children[name])
+		}
+	}
+	walk(path, node)
+	return true
+}
+
 // EqualsIgnore compares two AFS trees, and checks for structural equality
 // It provides an option for ignoring the inequality of the root names
 func (tree *Tree) EqualsIgnore(other *Tree, ignoreRootName bool) bool {
@@ -382,38 +545,95 @@ func (node *Node) EqualsIgnore(other *Node, ignoreName, ignorePropagate bool) bo
 }
 
 // CalculateChecksums works on the local AFS only
-// Computes the MD5 sum for each file (leaf node) and puts it in
-func (tree *Tree) CalculateChecksums() error {
+// Computes the checksum for each file (leaf node) and puts it in.
+// Files whose checksum is found in cache (which may be nil) are not rehashed.
+// If keepExisting is true, neither are files which already have a checksum, so it must
+// be known to be current (as with those adopted from Drive for unchanged files),
+// and it is stored in cache along with the computed ones.
+// Files are hashed in parallel, using as many goroutines as there are CPUs.
+func (tree *Tree) CalculateChecksums(cache *ChecksumCache, keepExisting bool) error {
+	type hashJob struct {
+		node     *Node
+		path     string
+		checksum string
+		err      error
+	}
+
+	var jobs []*hashJob
 	pathParts := SplitPathPlatform(tree.name)
-	var calculate func(node *Node) error
-	calculate = func(node *Node) error {
+	var collect func(node *Node)
+	collect = func(node *Node) {
 		pathParts = append(pathParts, node.name)
 		if node.isDir {
 			for childName := range node.children {
-				child := node.children[childName]
-				if err := calculate(child); err != nil {
-					return err
-				}
-			}
-		} else {
-			path := JoinPathPlatform(pathParts, true)
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			sum := md5.New()
-			_, err = io.Copy(sum, file)
-			if err != nil {
-				return err
-			}
-			checksum := fmt.Sprintf("%x", sum.Sum(nil))
-			node.md5sum = checksum
-			if err = file.Close(); err != nil {
-				return err
+				collect(node.children[childName])
 			}
+		} else if node.checksum == "" || !keepExisting {
+			jobs = append(jobs, &hashJob{node: node, path: JoinPathPlatform(pathParts, true)})
+		} else if cache != nil && !node.meta.ModTime.IsZero() && !node.meta.IsSymlink() {
+			// Kept in the cache, so that the file is not rehashed when the checksum cannot be adopted again.
+			// The metadata of a symlink is that of the link, so it cannot tell whether its target has changed.
+			cache.Store(JoinPathPlatform(pathParts, true), node.meta, tree.algo, node.checksum)
 		}
 		pathParts = pathParts[0 : len(pathParts)-1]
-		return nil
 	}
-	return calculate(tree.root)
+	collect(tree.root)
+
+	jobChan := make(chan *hashJob)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobChan {
+				job.checksum, job.err = fileChecksum(job.path, tree.algo, cache)
+			}
+		}()
+	}
+	for _, job := range jobs {
+		jobChan <- job
+	}
+	close(jobChan)
+	wg.Wait()
+
+	// Nodes are only modified here, since setting checksums invalidates hashes up the tree
+	for _, job := range jobs {
+		if job.err != nil {
+			return job.err
+		}
+		job.node.SetChecksum(job.checksum)
+	}
+	return nil
+}
+
+// Computes the checksum of the file at path, consulting and updating cache if it is non-nil.
+// A symlink is hashed by the contents of its target, so the cache is keyed on the target's
+// attributes, which change when it is edited, unlike those of the link.
+func fileChecksum(path string, algo HashAlgorithm, cache *ChecksumCache) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	meta := MetadataFromFileInfo(path, info)
+	if cache != nil {
+		if checksum, ok := cache.Lookup(path, meta, algo); ok {
+			return checksum, nil
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sum := algo.New()
+	if _, err = io.Copy(sum, file); err != nil {
+		return "", err
+	}
+	checksum := fmt.Sprintf("%x", sum.Sum(nil))
+
+	if cache != nil {
+		cache.Store(path, meta, algo, checksum)
+	}
+	return checksum, nil
 }
@@ -5,8 +5,10 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert"
+	"google.golang.org/api/drive/v3"
 )
 
 func extendNode(node *Node, currPath string) {
@@ -147,3 +149,139 @@ func TestRenamePath(t *testing.T) {
 	_, found = tree.findPath(filepath.Join(path, filepath.FromSlash("dirnew/file7")))
 	assert.True(found)
 }
+
+func TestHash(t *testing.T) {
+	assert := assert.New(t)
+	path, _ := filepath.Abs(filepath.FromSlash("test_data/rec_dir"))
+	tree := constructTree()
+	other := constructTree()
+	assert.Equal(tree.Root().Hash(), other.Root().Hash())
+
+	file6 := filepath.Join(path, filepath.FromSlash("dir1/dir3/file6"))
+	dir2Hash := tree.root.children["dir2"].Hash()
+	node, _ := tree.findPath(file6)
+	node.SetChecksum("abc")
+	assert.NotEqual(tree.Root().Hash(), other.Root().Hash())
+	assert.Equal(dir2Hash, tree.root.children["dir2"].Hash())
+	node, _ = other.findPath(file6)
+	node.SetChecksum("abc")
+	assert.Equal(tree.Root().Hash(), other.Root().Hash())
+
+	tree.RenamePath(file6, filepath.Join(path, filepath.FromSlash("dir2/file6")))
+	assert.NotEqual(dir2Hash, tree.root.children["dir2"].Hash())
+	assert.NotEqual(tree.Root().Hash(), other.Root().Hash())
+	other.RenamePath(file6, filepath.Join(path, filepath.FromSlash("dir2/file6")))
+	assert.Equal(tree.Root().Hash(), other.Root().Hash())
+
+	tree.DeletePath(filepath.Join(path, "file1"))
+	assert.NotEqual(tree.Root().Hash(), other.Root().Hash())
+	tree.AddPath(filepath.Join(path, "file1"), false)
+	assert.Equal(tree.Root().Hash(), other.Root().Hash())
+}
+
+func TestCalculateChecksumsAlgorithm(t *testing.T) {
+	assert := assert.New(t)
+	path, _ := filepath.Abs(filepath.FromSlash("test_data/rec_dir"))
+	file1 := filepath.Join(path, "file1")
+
+	tree := constructTree()
+	assert.NoError(tree.CalculateChecksums(nil, false))
+	node, _ := tree.findPath(file1)
+	assert.Equal("d41d8cd98f00b204e9800998ecf8427e", node.Checksum())
+
+	tree = constructTree()
+	tree.SetHashAlgorithm(SHA256)
+	assert.NoError(tree.CalculateChecksums(nil, false))
+	node, _ = tree.findPath(file1)
+	assert.Equal("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", node.Checksum())
+}
+
+func TestCalculateChecksumsKeepExisting(t *testing.T) {
+	assert := assert.New(t)
+	path, _ := filepath.Abs(filepath.FromSlash("test_data/rec_dir"))
+	file1 := filepath.Join(path, "file1")
+
+	tree := constructTree()
+	node, _ := tree.findPath(file1)
+	node.SetChecksum("adopted")
+	assert.NoError(tree.CalculateChecksums(nil, true))
+	assert.Equal("adopted", node.Checksum())
+
+	// A stale checksum is recomputed
+	assert.NoError(tree.CalculateChecksums(nil, false))
+	assert.Equal("d41d8cd98f00b204e9800998ecf8427e", node.Checksum())
+}
+
+func TestWalk(t *testing.T) {
+	assert := assert.New(t)
+	path, _ := filepath.Abs(filepath.FromSlash("test_data/rec_dir"))
+	tree := constructTree()
+
+	var walked []string
+	ok := tree.Walk(filepath.Join(path, "dir1"), func(path string, node *Node) {
+		walked = append(walked, path)
+	})
+	assert.True(ok)
+	assert.Equal([]string{
+		filepath.Join(path, "dir1"),
+		filepath.Join(path, filepath.FromSlash("dir1/dir3")),
+		filepath.Join(path, filepath.FromSlash("dir1/dir3/file6")),
+		filepath.Join(path, filepath.FromSlash("dir1/file4")),
+		filepath.Join(path, filepath.FromSlash("dir1/file5")),
+	}, walked)
+
+	assert.False(tree.Walk(filepath.Join(path, "dir10"), func(string, *Node) {}))
+}
+
+func TestDetachAndAttach(t *testing.T) {
+	assert := assert.New(t)
+	path, _ := filepath.Abs(filepath.FromSlash("test_data/rec_dir"))
+	tree := constructTree()
+	other := NewTree(filepath.Join(os.TempDir(), "other"))
+	otherHash := other.Root().Hash()
+
+	dir1 := filepath.Join(path, "dir1")
+	tree.AttachID(dir1, "dir1ID")
+	node, ok := tree.DetachPath(dir1)
+	assert.True(ok)
+	assert.False(tree.ContainsPath(dir1))
+
+	moved := filepath.Join(other.RootPath(), "moved")
+	assert.True(other.AttachNode(moved, node))
+	assert.NotEqual(otherHash, other.Root().Hash())
+	id, err := other.RetrieveID(moved)
+	assert.NoError(err)
+	assert.Equal("dir1ID", id)
+	assert.True(other.ContainsPath(filepath.Join(moved, filepath.FromSlash("dir3/file6"))))
+
+	_, ok = tree.DetachPath(path)
+	assert.False(ok)
+	assert.False(other.AttachNode(filepath.Join(other.RootPath(), filepath.FromSlash("missing/moved")), node))
+}
+
+func TestPathsOutsideTree(t *testing.T) {
+	assert := assert.New(t)
+	tree := NewTree(filepath.FromSlash("/home/work"))
+	assert.False(tree.AddPath(filepath.FromSlash("/home/workspace/file"), false))
+	assert.False(tree.ContainsPath(filepath.FromSlash("/home/workspace/file")))
+}
+
+func TestNewTreeFromDriveFolderMetadata(t *testing.T) {
+	assert := assert.New(t)
+	dirMeta := Metadata{ModTime: time.Unix(1600000000, 0), Mode: os.ModeDir | 0700}
+	fileMeta := Metadata{Size: 5, ModTime: time.Unix(1600000001, 0), Mode: 0640}
+	files := []*drive.File{
+		{Id: "dir", Name: "dir", Parents: []string{"root"}, MimeType: "application/vnd.google-apps.folder",
+			AppProperties: dirMeta.AppProperties()},
+		{Id: "file", Name: "file", Parents: []string{"dir"}, AppProperties: fileMeta.AppProperties()},
+	}
+
+	tree := NewTreeFromDriveFolder(files, "root", "backup", MD5)
+	dir := tree.Root().Children()["dir"]
+	// Directories carry their metadata too, to be restored
+	assert.True(dir.Metadata().ModTime.Equal(dirMeta.ModTime))
+	assert.Equal(dirMeta.Mode, dir.Metadata().Mode)
+	file := dir.Children()["file"]
+	assert.Equal("file", file.DriveID())
+	assert.True(fileMeta.Unchanged(file.Metadata()))
+}
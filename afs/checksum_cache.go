@@ -0,0 +1,99 @@
+package afs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/RedDocMD/piledriver/fileutil"
+)
+
+// ChecksumCache is a persistent cache of the checksums of local files.
+// An entry is only valid as long as the size, modification time and inode
+// of the file are unchanged (and the same hash algorithm is used),
+// so unchanged files need not be rehashed.
+type ChecksumCache struct {
+	path    string
+	entries map[string]cacheEntry
+	used    map[string]bool // Paths looked up or stored since the cache was loaded
+	mu      sync.Mutex
+}
+
+type cacheEntry struct {
+	Size      int64         `json:"size"`
+	ModTime   int64         `json:"mtime"`
+	Inode     uint64        `json:"inode"`
+	Algorithm HashAlgorithm `json:"algorithm"`
+	Checksum  string        `json:"checksum"`
+}
+
+func newCacheEntry(meta Metadata, algo HashAlgorithm, checksum string) cacheEntry {
+	return cacheEntry{
+		Size:      meta.Size,
+		ModTime:   meta.ModTime.UnixNano(),
+		Inode:     meta.Inode,
+		Algorithm: algo,
+		Checksum:  checksum,
+	}
+}
+
+// LoadChecksumCache loads the cache stored in the file at path.
+// If the file does not exist, an empty cache is returned.
+func LoadChecksumCache(path string) (*ChecksumCache, error) {
+	cache := &ChecksumCache{
+		path:    path,
+		entries: make(map[string]cacheEntry),
+		used:    make(map[string]bool),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &cache.entries); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+// Lookup returns the cached checksum of path, if it is present
+// and the file has not changed since it was stored
+func (cache *ChecksumCache) Lookup(path string, meta Metadata, algo HashAlgorithm) (string, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	entry, ok := cache.entries[path]
+	if !ok || entry != newCacheEntry(meta, algo, entry.Checksum) {
+		return "", false
+	}
+	cache.used[path] = true
+	return entry.Checksum, true
+}
+
+// Store caches the checksum of path, computed by algo
+func (cache *ChecksumCache) Store(path string, meta Metadata, algo HashAlgorithm, checksum string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.entries[path] = newCacheEntry(meta, algo, checksum)
+	cache.used[path] = true
+}
+
+// Save writes the cache back to the file it was loaded from.
+// Only the entries looked up or stored since loading are kept,
+// so that the cache does not grow with files which no longer exist.
+func (cache *ChecksumCache) Save() error {
+	cache.mu.Lock()
+	entries := make(map[string]cacheEntry)
+	for path := range cache.used {
+		entries[path] = cache.entries[path]
+	}
+	cache.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return fileutil.WriteFileAtomic(cache.path, data, 0600)
+}
@@ -0,0 +1,146 @@
+package afs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestChecksumCache(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "cache")
+
+	cache, err := LoadChecksumCache(cachePath)
+	assert.NoError(err)
+	meta := Metadata{Size: 10, ModTime: time.Unix(1600000000, 0), Inode: 7}
+	cache.Store("/a/file", meta, MD5, "abc")
+	cache.Store("/a/other", meta, MD5, "def")
+	assert.NoError(cache.Save())
+
+	cache, err = LoadChecksumCache(cachePath)
+	assert.NoError(err)
+	checksum, ok := cache.Lookup("/a/file", meta, MD5)
+	assert.True(ok)
+	assert.Equal("abc", checksum)
+
+	changed := meta
+	changed.ModTime = changed.ModTime.Add(time.Second)
+	_, ok = cache.Lookup("/a/file", changed, MD5)
+	assert.False(ok)
+	changed = meta
+	changed.Inode = 8
+	_, ok = cache.Lookup("/a/file", changed, MD5)
+	assert.False(ok)
+	_, ok = cache.Lookup("/a/file", meta, SHA256)
+	assert.False(ok)
+
+	// Only used entries survive a save
+	assert.NoError(cache.Save())
+	cache, err = LoadChecksumCache(cachePath)
+	assert.NoError(err)
+	_, ok = cache.Lookup("/a/file", meta, MD5)
+	assert.True(ok)
+	_, ok = cache.Lookup("/a/other", meta, MD5)
+	assert.False(ok)
+}
+
+func TestCalculateChecksumsUsesCache(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := LoadChecksumCache(filepath.Join(dir, "cache"))
+	assert.NoError(err)
+
+	path, _ := filepath.Abs(filepath.FromSlash("test_data/rec_dir"))
+	file1 := filepath.Join(path, "file1")
+	tree := constructTree()
+	assert.NoError(tree.CalculateChecksums(cache, false))
+	node, _ := tree.findPath(file1)
+	checksum := node.Checksum()
+	assert.NotEqual("", checksum)
+
+	meta, err := ReadMetadata(file1)
+	assert.NoError(err)
+	cached, ok := cache.Lookup(file1, meta, MD5)
+	assert.True(ok)
+	assert.Equal(checksum, cached)
+
+	// A bogus cached value proves the file is not rehashed
+	cache.Store(file1, meta, MD5, "cached")
+	tree = constructTree()
+	assert.NoError(tree.CalculateChecksums(cache, false))
+	node, _ = tree.findPath(file1)
+	assert.Equal("cached", node.Checksum())
+}
+
+func TestCalculateChecksumsCachesExisting(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "cache")
+	cache, err := LoadChecksumCache(cachePath)
+	assert.NoError(err)
+
+	path, _ := filepath.Abs(filepath.FromSlash("test_data/rec_dir"))
+	file1 := filepath.Join(path, "file1")
+	meta, err := ReadMetadata(file1)
+	assert.NoError(err)
+	tree := constructTree()
+	tree.AttachMetadata(file1, meta)
+	node, _ := tree.findPath(file1)
+	node.SetChecksum("adopted")
+	assert.NoError(tree.CalculateChecksums(cache, true))
+	assert.NoError(cache.Save())
+
+	cache, err = LoadChecksumCache(cachePath)
+	assert.NoError(err)
+	cached, ok := cache.Lookup(file1, meta, MD5)
+	assert.True(ok)
+	assert.Equal("adopted", cached)
+}
+
+func TestCalculateChecksumsSymlinkTarget(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache, err := LoadChecksumCache(filepath.Join(dir, "cache"))
+	assert.NoError(err)
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	assert.NoError(ioutil.WriteFile(target, []byte("a"), 0644))
+	if err := os.Symlink("target", link); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	checksum := func() string {
+		tree := NewTree(dir)
+		tree.AddPath(link, false)
+		assert.NoError(tree.CalculateChecksums(cache, false))
+		node, _ := tree.findPath(link)
+		return node.Checksum()
+	}
+	assert.Equal("0cc175b9c0f1b6a831c399e269772661", checksum())
+
+	// Editing the target leaves the link itself unchanged
+	assert.NoError(ioutil.WriteFile(target, []byte("b"), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(target, later, later))
+	assert.Equal("92eb5ffee6ae2fec3ad71c777531578f", checksum())
+}
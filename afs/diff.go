@@ -0,0 +1,166 @@
+package afs
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// ChangeKind denotes the type of difference found between two trees
+type ChangeKind int
+
+// Various kinds of changes
+const (
+	Added ChangeKind = iota
+	Removed
+	ContentChanged
+	TypeChanged
+	Moved
+)
+
+func (kind ChangeKind) String() string {
+	switch kind {
+	case Added:
+		return "ADDED"
+	case Removed:
+		return "REMOVED"
+	case ContentChanged:
+		return "CONTENT CHANGED"
+	case TypeChanged:
+		return "TYPE CHANGED"
+	case Moved:
+		return "MOVED"
+	default:
+		return "Unknown change kind"
+	}
+}
+
+// Change is a single difference between two trees.
+// Paths are relative to the roots of the trees being compared.
+// OldPath is only set for Moved changes.
+type Change struct {
+	Kind    ChangeKind
+	Path    string
+	OldPath string
+	IsDir   bool
+}
+
+func (change Change) String() string {
+	if change.Kind == Moved {
+		return fmt.Sprintf("%s   %s => %s", change.Kind, change.OldPath, change.Path)
+	}
+	return fmt.Sprintf("%s   %s", change.Kind, change.Path)
+}
+
+// Diff compares this tree with other and returns the changes
+// that turn this tree into other, sorted by path.
+// The names of the roots are not compared.
+// When a directory is added or removed, only the directory itself is reported.
+// A file (or non-empty directory) which is removed from one path and added to another
+// with the same (non-empty) hash is reported as Moved.
+// Subtrees with identical Merkle hashes are skipped without being visited.
+func (tree *Tree) Diff(other *Tree) []Change {
+	var changes, added, removed []Change
+	var diff func(oldNode, newNode *Node, relPath string)
+	diff = func(oldNode, newNode *Node, relPath string) {
+		for name, oldChild := range oldNode.children {
+			childPath := filepath.Join(relPath, name)
+			newChild, ok := newNode.children[name]
+			if !ok {
+				removed = append(removed, Change{Kind: Removed, Path: childPath, IsDir: oldChild.isDir})
+				continue
+			}
+			if oldChild.isDir != newChild.isDir {
+				changes = append(changes, Change{Kind: TypeChanged, Path: childPath, IsDir: newChild.isDir})
+				continue
+			}
+			if oldChild.isDir {
+				if oldChild.Hash() != newChild.Hash() {
+					diff(oldChild, newChild, childPath)
+				}
+			} else if oldChild.checksum != newChild.checksum {
+				changes = append(changes, Change{Kind: ContentChanged, Path: childPath})
+			}
+		}
+		for name, newChild := range newNode.children {
+			if _, ok := oldNode.children[name]; !ok {
+				childPath := filepath.Join(relPath, name)
+				added = append(added, Change{Kind: Added, Path: childPath, IsDir: newChild.isDir})
+			}
+		}
+	}
+	if tree.root.Hash() != other.root.Hash() {
+		diff(tree.root, other.root, "")
+	}
+
+	sortChanges(added)
+	sortChanges(removed)
+
+	// Pair up removed and added nodes having the same hash as moves
+	removedByHash := make(map[string][]int)
+	for i, change := range removed {
+		node, _ := tree.findRelPath(change.Path)
+		if key := moveKey(node); key != "" {
+			removedByHash[key] = append(removedByHash[key], i)
+		}
+	}
+	movedFrom := make(map[int]bool)
+	for _, change := range added {
+		node, _ := other.findRelPath(change.Path)
+		key := moveKey(node)
+		if candidates := removedByHash[key]; key != "" && len(candidates) != 0 {
+			removedByHash[key] = candidates[1:]
+			movedFrom[candidates[0]] = true
+			changes = append(changes, Change{
+				Kind:    Moved,
+				Path:    change.Path,
+				OldPath: removed[candidates[0]].Path,
+				IsDir:   change.IsDir,
+			})
+			continue
+		}
+		changes = append(changes, change)
+	}
+	for i, change := range removed {
+		if !movedFrom[i] {
+			changes = append(changes, change)
+		}
+	}
+
+	sortChanges(changes)
+	return changes
+}
+
+// Returns the key used to match removed and added nodes as moves,
+// or empty if the node cannot be matched
+func moveKey(node *Node) string {
+	if node.isDir {
+		if len(node.children) == 0 {
+			return ""
+		}
+		return "d" + node.Hash()
+	}
+	if node.checksum == "" {
+		return ""
+	}
+	return "f" + node.checksum
+}
+
+func sortChanges(changes []Change) {
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+}
+
+// Given a path relative to the root, searches if it is in the tree
+func (tree *Tree) findRelPath(relPath string) (*Node, bool) {
+	node := tree.root
+	for _, part := range SplitPathPlatform(relPath) {
+		child, ok := node.children[part]
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node, true
+}
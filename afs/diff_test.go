@@ -0,0 +1,81 @@
+package afs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+func addFileWithSum(tree *Tree, relPath, checksum string) {
+	path := filepath.Join(tree.RootPath(), filepath.FromSlash(relPath))
+	tree.AddPath(path, false)
+	node, _ := tree.findPath(path)
+	node.SetChecksum(checksum)
+}
+
+func TestDiffIdentical(t *testing.T) {
+	assert := assert.New(t)
+	oldTree := NewTree(filepath.FromSlash("/tmp/old"))
+	newTree := NewTree(filepath.FromSlash("/tmp/new"))
+	for _, tree := range []*Tree{oldTree, newTree} {
+		addFileWithSum(tree, "dir1/file1", "aaa")
+		addFileWithSum(tree, "file2", "bbb")
+	}
+	assert.Equal(0, len(oldTree.Diff(newTree)))
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	oldTree := NewTree(filepath.FromSlash("/tmp/old"))
+	newTree := NewTree(filepath.FromSlash("/tmp/new"))
+
+	addFileWithSum(oldTree, "dir1/file1", "aaa")
+	addFileWithSum(newTree, "dir1/file1", "aab")
+
+	addFileWithSum(oldTree, "file2", "bbb")
+	addFileWithSum(newTree, "dir1/file2", "bbb")
+
+	addFileWithSum(oldTree, "gone", "ccc")
+	addFileWithSum(newTree, "fresh", "ddd")
+
+	addFileWithSum(oldTree, "kind", "eee")
+	newTree.AddPath(filepath.Join(newTree.RootPath(), "kind"), true)
+
+	changes := oldTree.Diff(newTree)
+	expected := []Change{
+		{Kind: ContentChanged, Path: filepath.FromSlash("dir1/file1")},
+		{Kind: Moved, Path: filepath.FromSlash("dir1/file2"), OldPath: "file2"},
+		{Kind: Added, Path: "fresh"},
+		{Kind: Removed, Path: "gone"},
+		{Kind: TypeChanged, Path: "kind", IsDir: true},
+	}
+	assert.Equal(expected, changes)
+}
+
+func TestDiffReportsTopDirectoryOnly(t *testing.T) {
+	assert := assert.New(t)
+	oldTree := NewTree(filepath.FromSlash("/tmp/old"))
+	newTree := NewTree(filepath.FromSlash("/tmp/new"))
+	addFileWithSum(newTree, "dir1/dir2/file1", "aaa")
+	addFileWithSum(newTree, "dir1/file2", "bbb")
+
+	changes := oldTree.Diff(newTree)
+	assert.Equal([]Change{{Kind: Added, Path: "dir1", IsDir: true}}, changes)
+
+	changes = newTree.Diff(oldTree)
+	assert.Equal([]Change{{Kind: Removed, Path: "dir1", IsDir: true}}, changes)
+}
+
+func TestDiffDetectsMovedDirectory(t *testing.T) {
+	assert := assert.New(t)
+	oldTree := NewTree(filepath.FromSlash("/tmp/old"))
+	newTree := NewTree(filepath.FromSlash("/tmp/new"))
+	addFileWithSum(oldTree, "dir1/file1", "aaa")
+	addFileWithSum(oldTree, "dir1/sub/file2", "bbb")
+	addFileWithSum(newTree, "dir2/file1", "aaa")
+	addFileWithSum(newTree, "dir2/sub/file2", "bbb")
+
+	changes := oldTree.Diff(newTree)
+	assert.Equal([]Change{{Kind: Moved, Path: "dir2", OldPath: "dir1", IsDir: true}}, changes)
+}
@@ -0,0 +1,70 @@
+package afs
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// HashAlgorithm denotes the hash function used to compute the checksums of files
+type HashAlgorithm string
+
+// Supported hash algorithms
+const (
+	MD5    HashAlgorithm = "md5"
+	SHA256 HashAlgorithm = "sha256"
+)
+
+// ParseHashAlgorithm returns the hash algorithm with the given name.
+// An empty name denotes the default, MD5.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	switch algo := HashAlgorithm(strings.ToLower(name)); algo {
+	case "":
+		return MD5, nil
+	case MD5, SHA256:
+		return algo, nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm: %s", name)
+	}
+}
+
+// New returns a new hash.Hash computing the checksum with this algorithm
+func (algo HashAlgorithm) New() hash.Hash {
+	if algo == SHA256 {
+		return sha256.New()
+	}
+	return md5.New()
+}
+
+// AppProperty returns the key of the appProperty under which the checksum is stored in Drive.
+// It is empty for MD5, since Drive computes it by itself.
+func (algo HashAlgorithm) AppProperty() string {
+	if algo == SHA256 {
+		return "sha256sum"
+	}
+	return ""
+}
+
+// LegacyChecksumProperty is the key of the appProperty under which earlier versions stored
+// the MD5 checksum of files, which is now taken from Drive itself
+const LegacyChecksumProperty = "md5sum"
+
+// ChecksumPropertyKeys returns the keys of all the appProperties under which checksums may be stored,
+// including LegacyChecksumProperty
+func ChecksumPropertyKeys() []string {
+	return []string{SHA256.AppProperty(), LegacyChecksumProperty}
+}
+
+// ChecksumOf returns the checksum of a file in Drive.
+// For MD5, this is the checksum computed by Drive, otherwise it is the one
+// recorded in the appProperties on upload.
+func (algo HashAlgorithm) ChecksumOf(file *drive.File) string {
+	if key := algo.AppProperty(); key != "" {
+		return file.AppProperties[key]
+	}
+	return file.Md5Checksum
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package afs
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the inode number of the file described by info, or 0 if unavailable
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
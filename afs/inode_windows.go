@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package afs
+
+import "os"
+
+// Windows does not expose inode numbers through os.FileInfo
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
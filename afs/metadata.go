@@ -0,0 +1,120 @@
+package afs
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Keys under which the metadata is stored in the appProperties of a Drive file
+const (
+	sizeProperty    = "size"
+	mtimeProperty   = "mtime"
+	modeProperty    = "mode"
+	symlinkProperty = "symlink"
+)
+
+// MaxPropertySize is the limit Drive sets on the size of the key and value of each appProperty (in bytes)
+const MaxPropertySize = 124
+
+// Metadata holds the file system attributes of a node, apart from its contents
+type Metadata struct {
+	Size          int64
+	ModTime       time.Time
+	Mode          os.FileMode
+	SymlinkTarget string // Empty if the node is not a symlink
+	Inode         uint64 // Only known locally, it is not stored in Drive
+}
+
+// ReadMetadata reads the metadata of the given path from the OS.
+// Symlinks are not followed.
+func ReadMetadata(path string) (Metadata, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return MetadataFromFileInfo(path, info), nil
+}
+
+// MetadataFromFileInfo creates the metadata for a path from the result of
+// an os.Lstat call on it
+func MetadataFromFileInfo(path string, info os.FileInfo) Metadata {
+	meta := Metadata{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+		Inode:   fileInode(info),
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(path); err == nil {
+			meta.SymlinkTarget = target
+		}
+	}
+	return meta
+}
+
+// MetadataFromAppProperties reconstructs the metadata stored in the
+// appProperties of a Drive file. Missing or malformed fields are left zero.
+func MetadataFromAppProperties(props map[string]string) Metadata {
+	var meta Metadata
+	if size, err := strconv.ParseInt(props[sizeProperty], 10, 64); err == nil {
+		meta.Size = size
+	}
+	if mtime, err := strconv.ParseInt(props[mtimeProperty], 10, 64); err == nil {
+		meta.ModTime = time.Unix(0, mtime)
+	}
+	if mode, err := strconv.ParseUint(props[modeProperty], 8, 32); err == nil {
+		meta.Mode = os.FileMode(mode)
+	}
+	meta.SymlinkTarget = props[symlinkProperty]
+	return meta
+}
+
+// AppProperties returns the metadata encoded as appProperties for a Drive file.
+// A symlink target too long to be stored in Drive is dropped.
+func (meta Metadata) AppProperties() map[string]string {
+	props := map[string]string{
+		sizeProperty:  strconv.FormatInt(meta.Size, 10),
+		mtimeProperty: strconv.FormatInt(meta.ModTime.UnixNano(), 10),
+		modeProperty:  strconv.FormatUint(uint64(meta.Mode), 8),
+	}
+	if meta.SymlinkTarget != "" && len(symlinkProperty)+len(meta.SymlinkTarget) <= MaxPropertySize {
+		props[symlinkProperty] = meta.SymlinkTarget
+	}
+	return props
+}
+
+// MetadataPropertyKeys returns the keys of all the appProperties under which metadata may be stored
+func MetadataPropertyKeys() []string {
+	return []string{sizeProperty, mtimeProperty, modeProperty, symlinkProperty}
+}
+
+// IsSymlink returns whether the metadata belongs to a symlink
+func (meta Metadata) IsSymlink() bool {
+	return meta.Mode&os.ModeSymlink != 0
+}
+
+// Unchanged returns whether the contents described by both the metadata are
+// (most probably) the same, that is, they have the same size and modification time.
+func (meta Metadata) Unchanged(other Metadata) bool {
+	return !meta.ModTime.IsZero() &&
+		meta.Size == other.Size &&
+		meta.ModTime.Equal(other.ModTime)
+}
+
+// Apply sets the permissions and modification time of path from the metadata.
+// It is a no-op for symlinks.
+func (meta Metadata) Apply(path string) error {
+	if meta.IsSymlink() {
+		return nil
+	}
+	if meta.Mode != 0 {
+		if err := os.Chmod(path, meta.Mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if !meta.ModTime.IsZero() {
+		return os.Chtimes(path, meta.ModTime, meta.ModTime)
+	}
+	return nil
+}
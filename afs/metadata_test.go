@@ -0,0 +1,54 @@
+package afs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestMetadataAppProperties(t *testing.T) {
+	assert := assert.New(t)
+	meta := Metadata{
+		Size:          42,
+		ModTime:       time.Unix(1600000000, 123456789),
+		Mode:          0640,
+		SymlinkTarget: "../target",
+	}
+	restored := MetadataFromAppProperties(meta.AppProperties())
+	assert.Equal(meta.Size, restored.Size)
+	assert.True(meta.ModTime.Equal(restored.ModTime))
+	assert.Equal(meta.Mode, restored.Mode)
+	assert.Equal(meta.SymlinkTarget, restored.SymlinkTarget)
+	assert.True(meta.Unchanged(restored))
+
+	meta.SymlinkTarget = strings.Repeat("a", MaxPropertySize)
+	_, ok := meta.AppProperties()[symlinkProperty]
+	assert.False(ok)
+}
+
+func TestMetadataApply(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	meta := Metadata{Size: 5, ModTime: time.Unix(1600000000, 0), Mode: 0644}
+	assert.NoError(meta.Apply(path))
+	read, err := ReadMetadata(path)
+	assert.NoError(err)
+	assert.True(meta.Unchanged(read))
+	if os.PathSeparator == '/' {
+		assert.Equal(meta.Mode, read.Mode)
+	}
+}
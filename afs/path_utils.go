@@ -38,3 +38,14 @@ func joinPath(parts []string, sep string, isAbs bool) string {
 func JoinPathPlatform(parts []string, isAbs bool) string {
 	return joinPath(parts, string(filepath.Separator), isAbs)
 }
+
+// IsSubPath returns whether path is dir itself or lies inside dir
+func IsSubPath(path, dir string) bool {
+	if path == dir {
+		return true
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, dir)
+}
@@ -1,6 +1,7 @@
 package afs
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/alecthomas/assert"
@@ -147,3 +148,13 @@ func TestWindowsRelDirPathSplit(t *testing.T) {
 		assert.Equal(partsExp[i], part)
 	}
 }
+
+func TestIsSubPath(t *testing.T) {
+	assert := assert.New(t)
+	dir := filepath.FromSlash("/home/joe")
+	assert.True(IsSubPath(dir, dir))
+	assert.True(IsSubPath(filepath.FromSlash("/home/joe/walk"), dir))
+	assert.True(IsSubPath(filepath.FromSlash("/home/joe/walk"), dir+string(filepath.Separator)))
+	assert.False(IsSubPath(filepath.FromSlash("/home/joey"), dir))
+	assert.False(IsSubPath(filepath.FromSlash("/home"), dir))
+}
@@ -26,6 +26,7 @@ func ToDrive(
 			remoteRootName,
 			rootID,
 			true,
+			localTree.HashAlgorithm(),
 		)
 	}
 	pathParts := afs.SplitPathPlatform(rootPath)
@@ -39,6 +40,7 @@ func ToDrive(
 				remoteRootName,
 				driveNode.Parent().DriveID(),
 				false,
+				localTree.HashAlgorithm(),
 			)
 		}
 		localChildren := localNode.Children()
@@ -56,6 +58,7 @@ func ToDrive(
 					remoteRootName,
 					driveNode.DriveID(),
 					false,
+					localTree.HashAlgorithm(),
 				)
 			} else {
 				driveChildrenCovered = append(driveChildrenCovered, driveChild)
@@ -94,16 +97,15 @@ func backupNode(
 	node *afs.Node,
 	service *drive.Service,
 	localPath, rootRemoteName, parentID string,
-	isRoot bool) error {
+	isRoot bool,
+	algo afs.HashAlgorithm) error {
 
 	if node.IsDir() {
-		var id string
-		var err error
+		name := localPath
 		if isRoot {
-			id, err = utils.CreateFolder(service, rootRemoteName, parentID)
-		} else {
-			id, err = utils.CreateFolder(service, localPath, parentID)
+			name = rootRemoteName
 		}
+		id, err := utils.CreateDirectoryFolder(service, name, node.Metadata(), parentID)
 		if err != nil {
 			return err
 		}
@@ -119,13 +121,14 @@ func backupNode(
 				rootRemoteName,
 				id,
 				false,
+				algo,
 			)
 			if err != nil {
 				return err
 			}
 		}
 	} else {
-		if _, err := utils.CreateFile(service, localPath, parentID); err != nil {
+		if _, err := utils.CreateFile(service, localPath, parentID, algo); err != nil {
 			return err
 		}
 	}
@@ -150,6 +153,31 @@ func AttachIDS(localTree, driveTree *afs.Tree) {
 	attach(localTree.Root(), driveTree.Root())
 }
 
+// AdoptChecksums copies the checksums from the Drive AFS to the local AFS
+// for files whose size and modification time have not changed since they were uploaded,
+// so that they need not be rehashed. Symlinks are always rehashed, since those of the link
+// do not change when its target is edited.
+// It assumes that the two trees have the same structure, ie, they return
+// true for drive.EqualsIgnore(local, true).
+func AdoptChecksums(localTree, driveTree *afs.Tree) {
+	var adopt func(localNode, driveNode *afs.Node)
+	adopt = func(localNode, driveNode *afs.Node) {
+		if !localNode.IsDir() {
+			meta := localNode.Metadata()
+			if driveNode.Checksum() != "" && !meta.IsSymlink() && meta.Unchanged(driveNode.Metadata()) {
+				localNode.SetChecksum(driveNode.Checksum())
+			}
+			return
+		}
+		localChildren := localNode.Children()
+		driveChildren := driveNode.Children()
+		for childName := range localChildren {
+			adopt(localChildren[childName], driveChildren[childName])
+		}
+	}
+	adopt(localTree.Root(), driveTree.Root())
+}
+
 // UpdateDriveTree updates the drive tree to match the local tree,
 // updating files when they mismatch (from the checksums).
 // It assumes that the two trees have the same structure, ie, they return
@@ -162,14 +190,17 @@ func UpdateDriveTree(localTree, driveTree *afs.Tree, service *drive.Service) err
 	update = func(localNode, driveNode *afs.Node) error {
 		pathParts = append(pathParts, localNode.Name())
 		if localNode.IsDir() {
-			localChildren := localNode.Children()
-			driveChildren := driveNode.Children()
-			for childName := range localChildren {
-				localChild := localChildren[childName]
-				driveChild := driveChildren[childName]
-				err := update(localChild, driveChild)
-				if err != nil {
-					return err
+			// Identical subtrees need not be visited
+			if localNode.Hash() != driveNode.Hash() {
+				localChildren := localNode.Children()
+				driveChildren := driveNode.Children()
+				for childName := range localChildren {
+					localChild := localChildren[childName]
+					driveChild := driveChildren[childName]
+					err := update(localChild, driveChild)
+					if err != nil {
+						return err
+					}
 				}
 			}
 		} else {
@@ -178,13 +209,15 @@ func UpdateDriveTree(localTree, driveTree *afs.Tree, service *drive.Service) err
 					service,
 					afs.JoinPathPlatform(pathParts, true),
 					localNode.DriveID(),
+					localTree.HashAlgorithm(),
 				)
 				if err != nil {
 					return err
 				}
-				newChecksum := file.AppProperties["md5sum"]
+				newChecksum := localTree.HashAlgorithm().ChecksumOf(file)
 				driveNode.SetChecksum(newChecksum)
 				localNode.SetChecksum(newChecksum)
+				driveNode.SetMetadata(afs.MetadataFromAppProperties(file.AppProperties))
 			}
 		}
 		pathParts = pathParts[0 : len(pathParts)-1]
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/utils"
+)
+
+// DirectoryTree is the local tree of a configured directory,
+// along with the name of the folder it is backed up to in Drive
+type DirectoryTree struct {
+	Local      *afs.Tree
+	RemoteName string
+}
+
+// Reconcile makes Drive consistent with the local trees of dirs, by first making the structure
+// of the trees in Drive match (with ToDrive), and then updating the files whose checksums differ.
+// The drive ID's are attached to the local trees and their checksums are calculated, using cache
+// if it is not nil.
+// The folders of dirs in Drive are in the root folder of remote.
+func Reconcile(dirs []DirectoryTree, remote *utils.Remote, cache *afs.ChecksumCache) error {
+	service, rootID := remote.Service, remote.RootFolderID
+	driveTrees := make([]*afs.Tree, len(dirs))
+	for i, dir := range dirs {
+		tree, err := queryDriveTree(remote, dir)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve %s from Drive: %s", dir.RemoteName, err)
+		}
+		if tree == nil {
+			log.Printf("Didn't find %s in Drive\n", dir.RemoteName)
+		}
+		driveTrees[i] = tree
+	}
+	log.Println("Retrieved file info from Drive")
+
+	// First make sure that the local and drive trees have the same structure
+	updated := false
+	for i, dir := range dirs {
+		localTree := dir.Local
+		if driveTrees[i] == nil || !localTree.EqualsIgnore(driveTrees[i], true) {
+			updated = true
+			log.Printf("Backing up tree in %s ...\n", localTree.RootPath())
+			err := ToDrive(localTree, driveTrees[i], dir.RemoteName, service, rootID)
+			if err != nil {
+				return fmt.Errorf("failed to perform force backup: %s", err)
+			}
+			log.Printf("Backed up tree in %s\n", localTree.RootPath())
+		}
+	}
+
+	// Update the drive trees to reflect the changes.
+	// The folders created by ToDrive are unmarked, so they are marked when they are adopted here.
+	if updated {
+		for i, dir := range dirs {
+			tree, err := queryDriveTree(remote, dir)
+			if err != nil {
+				return fmt.Errorf("failed to retrieve %s from Drive: %s", dir.RemoteName, err)
+			}
+			if tree == nil {
+				return fmt.Errorf("failed to find drive tree rooted at %s corresponding to local tree at %s", dir.RemoteName, dir.Local.RootPath())
+			}
+			driveTrees[i] = tree
+		}
+		log.Println("Retrieved file info from Drive")
+	}
+
+	// Attach the drive ID's to the local tree
+	for i, dir := range dirs {
+		AttachIDS(dir.Local, driveTrees[i])
+		log.Printf("Attached ID's to tree with root path %s\n", dir.Local.RootPath())
+	}
+
+	// Check if the local version of files is more recent than the drive version
+	for i, dir := range dirs {
+		localTree := dir.Local
+		AdoptChecksums(localTree, driveTrees[i])
+		err := localTree.CalculateChecksums(cache, true)
+		if err != nil {
+			return fmt.Errorf("failed to calculate local tree checksums: %s", err)
+		}
+		log.Printf("Calculated checksums for tree rooted at %s\n", localTree.RootPath())
+		err = UpdateDriveTree(localTree, driveTrees[i], service)
+		if err != nil {
+			return fmt.Errorf("failed to update changed files for tree rooted at %s: %s", localTree.RootPath(), err)
+		}
+		log.Printf("Updated to drive, tree rooted at %s\n", localTree.RootPath())
+	}
+	return nil
+}
+
+// Returns the tree in Drive of the folder in the root folder of remote which dir is backed up to,
+// or nil if there is no such folder. The folder is found by its marker, or else by its name.
+func queryDriveTree(remote *utils.Remote, dir DirectoryTree) (*afs.Tree, error) {
+	props := utils.DirectoryProperties(remote.MachineID, dir.Local.RootPath())
+	id, err := utils.AdoptFolder(remote.Service, remote.DriveID, remote.RootFolderID, dir.RemoteName, props)
+	if errors.Is(err, utils.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	files, err := utils.QueryDescendants(remote.Service, remote.DriveID, id)
+	if err != nil {
+		return nil, err
+	}
+	parts := afs.SplitPathPlatform(dir.RemoteName)
+	return afs.NewTreeFromDriveFolder(files, id, parts[len(parts)-1], dir.Local.HashAlgorithm()), nil
+}
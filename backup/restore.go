@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/utils"
+	"google.golang.org/api/drive/v3"
+)
+
+// Restore recreates the Drive tree in the local directory dest, which must not exist or be empty,
+// so that no local file is overwritten.
+// Files are downloaded from Drive, symlinks are recreated and
+// the permissions and modification times recorded in Drive are reapplied.
+// Those of a directory are reapplied once its contents have been written, which changes them.
+func Restore(driveTree *afs.Tree, dest string, service *drive.Service) error {
+	entries, err := ioutil.ReadDir(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dest)
+	}
+
+	var restore func(node *afs.Node, path string) error
+	restore = func(node *afs.Node, path string) error {
+		meta := node.Metadata()
+		if node.IsDir() {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+			children := node.Children()
+			for name := range children {
+				if err := restore(children[name], filepath.Join(path, name)); err != nil {
+					return err
+				}
+			}
+			return meta.Apply(path)
+		}
+		if meta.IsSymlink() && meta.SymlinkTarget != "" {
+			return os.Symlink(meta.SymlinkTarget, path)
+		}
+		if err := utils.DownloadFile(service, node.DriveID(), path); err != nil {
+			return err
+		}
+		return meta.Apply(path)
+	}
+	return restore(driveTree.Root(), dest)
+}
@@ -15,14 +15,51 @@ var authCmd = &cobra.Command{
 	Long: `This command authenticates Piledriver via OAuth 2.0. This way
 it has access to your Google Drive, but limited to only the files
 Piledriver has created. So Piledriver cannot see files that it has
-not synced`,
+not synced, unless "scope" is set to "full" in the config.
+Your own OAuth client can be used by setting "clientCredentialsPath".
+
+By default, the authentication is done in a browser on the same machine.
+On a machine without a browser (eg, over SSH), use --device to enter a code
+on any other device instead, or --manual to open the authentication URL
+elsewhere and paste back the URL it redirects to.
+
+Google only allows --device with your own client of the "TVs and Limited
+Input devices" type, set in "clientCredentialsPath", and not with "scope"
+set to "full". Use --manual in those cases.
+
+Use --account to authenticate one of the accounts named in "accounts",
+rather than the default account.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var config config.Config
 		err := viper.Unmarshal(&config)
 		if err != nil {
 			log.Fatalf("Unable to parse config: %s\n", err)
 		}
-		utils.AuthorizeApp(config.TokenPath)
+		auth, err := config.Account(authAccount)
+		if err != nil {
+			log.Fatalf("Error in config file: %s\n", err)
+		}
+		readPassphrase(authAccount, &auth)
+		switch {
+		case auth.ServiceAccountKeyPath != "":
+			log.Println("A service account is configured, so no authentication is needed")
+		case authDevice && authManual:
+			log.Fatalf("Only one of --device and --manual may be given\n")
+		case authDevice:
+			utils.AuthorizeDevice(auth)
+		case authManual:
+			utils.AuthorizeManual(auth)
+		default:
+			utils.AuthorizeApp(auth)
+		}
 	},
-	DisableFlagsInUseLine: true,
+}
+
+var authDevice, authManual bool
+var authAccount string
+
+func init() {
+	authCmd.Flags().BoolVar(&authDevice, "device", false, "authenticate by entering a code on another device")
+	authCmd.Flags().BoolVar(&authManual, "manual", false, "authenticate by pasting the URL redirected to")
+	authCmd.Flags().StringVar(&authAccount, "account", "", "name of the account to authenticate (the default account if empty)")
 }
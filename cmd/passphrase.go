@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/RedDocMD/piledriver/config"
+)
+
+// Environment variable from which the passphrase of the token is read
+const passphraseEnv = "PILEDRIVER_PASSPHRASE"
+
+var passphraseFD int
+
+// Passphrase from --passphrase-fd or PILEDRIVER_PASSPHRASE, shared by the
+// accounts without a passphrase of their own
+var sharedPassphrase struct {
+	once  sync.Once
+	value string
+}
+
+// Passphrases read from the environment variables of named accounts, by account key
+var accountPassphrases = make(map[string]string)
+
+// Environment variable from which the passphrase of the token of the named
+// account is read: PILEDRIVER_PASSPHRASE_ followed by the name in upper case,
+// with anything other than letters and digits replaced by underscores.
+func accountPassphraseEnv(account string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, account)
+	return passphraseEnv + "_" + name
+}
+
+// Sets auth.Passphrase, if the token of the account is encrypted without a key
+// file. The account is named by account, or is the default account if it is empty.
+// A named account's passphrase is read from its own environment variable (see
+// accountPassphraseEnv). Failing that, it is read from the file descriptor given
+// by --passphrase-fd, or else from the environment variable PILEDRIVER_PASSPHRASE.
+func readPassphrase(account string, auth *config.AuthConfig) {
+	if !auth.EncryptToken || auth.TokenKeyPath != "" {
+		return
+	}
+	if account != "" {
+		if value, ok := accountPassphrases[accountKey(account)]; ok {
+			auth.Passphrase = value
+			return
+		}
+		env := accountPassphraseEnv(account)
+		if value := os.Getenv(env); value != "" {
+			// Not to be inherited by anything started later
+			os.Unsetenv(env)
+			accountPassphrases[accountKey(account)] = value
+			auth.Passphrase = value
+			return
+		}
+	}
+	sharedPassphrase.once.Do(func() {
+		if passphraseFD >= 0 {
+			file := os.NewFile(uintptr(passphraseFD), "passphrase")
+			data, err := ioutil.ReadAll(file)
+			if err != nil {
+				log.Fatalf("Failed to read passphrase from file descriptor %d: %s\n", passphraseFD, err)
+			}
+			file.Close()
+			sharedPassphrase.value = strings.TrimRight(string(data), "\r\n")
+		} else {
+			sharedPassphrase.value = os.Getenv(passphraseEnv)
+			os.Unsetenv(passphraseEnv)
+		}
+	})
+	if sharedPassphrase.value == "" {
+		if account == "" {
+			log.Fatalf("The token is encrypted: give its passphrase in %s or with --passphrase-fd\n", passphraseEnv)
+		}
+		log.Fatalf("The token of account %q is encrypted: give its passphrase in %s, or in %s or with --passphrase-fd\n",
+			account, accountPassphraseEnv(account), passphraseEnv)
+	}
+	auth.Passphrase = sharedPassphrase.value
+}
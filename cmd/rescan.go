@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/backup"
+	"github.com/RedDocMD/piledriver/config"
+	"github.com/RedDocMD/piledriver/utils"
+)
+
+// Delay before a failed rescan is retried, which doubles with each failure in a row up to maxRescanDelay
+const (
+	rescanRetryDelay = time.Minute
+	maxRescanDelay   = time.Hour
+)
+
+// Rescans the trees queued in state.Rescans, and reconciles them with Drive
+// just like on startup. Events are paused meanwhile, since they are executed
+// against the tree being replaced, and those queued before the rescan are dropped
+// when they are resumed, since Drive has been made consistent with the disk.
+// If the rescan fails, those events are kept and the rescan is queued again later.
+func rescanLoop(state *utils.State, config config.Config, cache *afs.ChecksumCache) {
+	retryDelays := make(map[string]time.Duration) // Map from root path to delay before retrying its failed rescan
+	for root := range state.Rescans {
+		var remoteName string
+		for _, dir := range config.Directories {
+			if filepath.Clean(dir.Local) == root {
+				remoteName = dir.Remote
+			}
+		}
+		remote, ok := state.Remote(root)
+		if remoteName == "" || !ok {
+			log.Printf("Cannot rescan %s, it is not a configured directory\n", root)
+			continue
+		}
+
+		log.Printf("Rescanning %s ...\n", root)
+		state.PauseEvents()
+		err := state.Rescan(root, func(tree *afs.Tree) error {
+			dirs := []backup.DirectoryTree{{Local: tree, RemoteName: remoteName}}
+			return backup.Reconcile(dirs, remote, cache)
+		})
+		state.ResumeEvents()
+		saveChecksumCache(cache)
+		if err == nil {
+			log.Printf("Rescanned %s\n", root)
+			delete(retryDelays, root)
+			continue
+		}
+
+		delay := retryDelays[root] * 2
+		if delay == 0 {
+			delay = rescanRetryDelay
+		} else if delay > maxRescanDelay {
+			delay = maxRescanDelay
+		}
+		retryDelays[root] = delay
+		log.Printf("Failed to rescan %s, retrying in %s: %s\n", root, delay, err)
+		rescanRoot := root
+		time.AfterFunc(delay, func() { state.RequestRescan(rescanRoot) })
+	}
+}
+
+// Periodically rescans all trees, to catch any drift between them and Drive
+// (such as from events lost during sleep, or edits made in Drive).
+// This relies on rescanLoop dropping the events queued before each rescan, which would
+// otherwise be executed against files that the reconciliation has deleted or replaced,
+// and on State.Rescan holding off the watchers while a tree is reconciled.
+func reconcileLoop(state *utils.State, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		log.Println("Starting periodic reconciliation")
+		state.RequestRescanAll()
+	}
+}
+
+func saveChecksumCache(cache *afs.ChecksumCache) {
+	if cache == nil {
+		return
+	}
+	if err := cache.Save(); err != nil {
+		log.Printf("Failed to save checksum cache: %s\n", err)
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/backup"
+	"github.com/RedDocMD/piledriver/config"
+	"github.com/RedDocMD/piledriver/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore REMOTE DEST",
+	Short: "Restore a backed up directory from Google Drive",
+	Long: `This command downloads the directory backed up in Google Drive under
+the name REMOTE into the local directory DEST. REMOTE may also be the path
+of a folder below a backed up directory, such as "AOC/2020". The permissions, modification
+times and symlinks recorded during backup are restored as well.
+DEST must not exist or be empty, so that no local file is overwritten.
+Use --account to restore from one of the accounts named in "accounts".`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var config config.Config
+		err := viper.Unmarshal(&config)
+		if err != nil {
+			log.Fatalf("Error in config file: %s\n", err)
+		}
+		auth, err := config.Account(restoreAccount)
+		if err != nil {
+			log.Fatalf("Error in config file: %s\n", err)
+		}
+		readPassphrase(restoreAccount, &auth)
+		remote, dest := args[0], args[1]
+
+		service := utils.GetDriveService(auth)
+		hashAlgorithm, err := afs.ParseHashAlgorithm(config.HashAlgorithm)
+		if err != nil {
+			log.Fatalf("Error in config file: %s\n", err)
+		}
+		rootFolder := fmt.Sprintf("piledriver-%s", config.MachineIdentifier)
+		rootID, err := utils.FindMarkedFolder(service, auth.SharedDriveID, "", utils.MachineProperties(config.MachineIdentifier))
+		if errors.Is(err, utils.ErrNotFound) {
+			// Created by an earlier version, which did not mark it
+			rootID, err = utils.QueryFileID(service, auth.SharedDriveID, "", rootFolder)
+		}
+		if err != nil {
+			log.Fatalf("Failed to find %s in Drive: %s\n", rootFolder, err)
+		}
+		remoteID, err := utils.ResolvePath(service, auth.SharedDriveID, rootID, remote)
+		if err != nil {
+			log.Fatalf("Failed to find %s in Drive: %s\n", remote, err)
+		}
+		driveFiles, err := utils.QueryDescendants(service, auth.SharedDriveID, remoteID)
+		if err != nil {
+			log.Fatalf("Failed to retrieve file list from Drive: %s\n", err)
+		}
+		driveTree := afs.NewTreeFromDriveFolder(driveFiles, remoteID, path.Base(remote), hashAlgorithm)
+		if err = backup.Restore(driveTree, dest, service); err != nil {
+			log.Fatalf("Failed to restore %s to %s: %s\n", remote, dest, err)
+		}
+		log.Printf("Restored %s to %s\n", remote, dest)
+	},
+	DisableFlagsInUseLine: true,
+}
+
+var restoreAccount string
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreAccount, "account", "", "name of the account to restore from (the default account if empty)")
+}
@@ -1,10 +1,13 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"time"
 
 	"github.com/RedDocMD/piledriver/afs"
 	"github.com/RedDocMD/piledriver/backup"
@@ -13,6 +16,7 @@ import (
 	"github.com/denisbrodbeck/machineid"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"google.golang.org/api/drive/v3"
 )
 
 var rootCmd = &cobra.Command{
@@ -26,115 +30,150 @@ var rootCmd = &cobra.Command{
 			log.Fatalf("Error in config file: %s\n", err)
 		}
 
-		state := utils.NewState()
-		state.InitService(config.TokenPath)
-		state.InitWatcher()
-		for _, dir := range config.Directories {
-			state.AddDir(dir.Local)
-		}
-
-		// Run the watch loop to accumulate changes in the init period
-		go utils.WatchLoop(state)
-
-		rootFolder := fmt.Sprintf("piledriver-%s", config.MachineIdentifier)
-		rootFolderID, err := utils.QueryFileID(state.Service(), rootFolder)
-		if err != nil && err.Error() == fmt.Sprintf("Didn't find %s in you Drive", rootFolder) {
-			rootFolderID, err = utils.CreateFolder(state.Service(), rootFolder)
-			if err != nil {
-				log.Fatalf("Failed to create rootFolder %s: %s\n", rootFolder, err)
-			}
-			log.Printf("Created %s as rootFolder\n", rootFolder)
-		} else if err != nil {
-			log.Fatalf("Failed to query rootFolder %s: %s\n", rootFolder, err)
-		}
-
-		driveFiles, err := utils.QueryAllContents(state.Service())
+		hashAlgorithm, err := afs.ParseHashAlgorithm(config.HashAlgorithm)
 		if err != nil {
-			log.Fatalf("Failed to retrieve file list from Drive: %s\n", err)
+			log.Fatalf("Error in config file: %s\n", err)
 		}
-		log.Println("Retrieved file info from Drive")
 
-		type TreeName struct {
-			tree       *afs.Tree
-			remoteName string
+		quietPeriods, err := utils.ParseQuietPeriods(config.QuietPeriods)
+		if err != nil {
+			log.Fatalf("Error in config file: %s\n", err)
 		}
 
-		driveTreesNames := make(map[string]TreeName)
-		for _, dir := range config.Directories {
-			tree, err := afs.NewTreeFromDrive(driveFiles, dir.Remote)
+		var reconcileInterval time.Duration
+		if config.ReconcileInterval != "" {
+			reconcileInterval, err = time.ParseDuration(config.ReconcileInterval)
 			if err != nil {
-				log.Println(err)
-				driveTreesNames[dir.Local] = TreeName{nil, dir.Remote}
-			} else {
-				driveTreesNames[dir.Local] = TreeName{tree, dir.Remote}
+				log.Fatalf("Error in config file: invalid reconcile interval: %s\n", err)
 			}
 		}
 
-		// First make sure that the local and drive trees have the same structure
-		updated := false
-		for dir := range driveTreesNames {
-			driveTreeName := driveTreesNames[dir]
-			localTree, _ := state.Tree(dir)
-			if driveTreeName.tree == nil || !localTree.EqualsIgnore(driveTreeName.tree, true) {
-				updated = true
-				log.Printf("Backing up tree in %s ...\n", localTree.RootPath())
-				err = backup.ToDrive(
-					localTree,
-					driveTreeName.tree,
-					driveTreeName.remoteName,
-					state.Service(),
-					rootFolderID,
-				)
+		state := utils.NewState()
+		state.SetHashAlgorithm(hashAlgorithm)
+		remotes := connectRemotes(state, config)
+		state.InitWatcher()
+		reportWatches(config.Directories)
+		for _, dir := range config.Directories {
+			if !dir.Poll {
+				state.AddDir(dir.Local)
+				continue
+			}
+			pollInterval := utils.DefaultPollInterval
+			if dir.PollInterval != "" {
+				pollInterval, err = time.ParseDuration(dir.PollInterval)
 				if err != nil {
-					log.Fatalf("Failed to perform force backup: %s", err)
+					log.Fatalf("Error in config file: invalid poll interval for %s: %s\n", dir.Local, err)
 				}
-				log.Printf("Backed up tree in %s\n", localTree.RootPath())
 			}
+			state.AddPolledDir(dir.Local, pollInterval)
 		}
 
-		// Update the drive trees to reflect the changes
-		if updated {
-			driveFiles, err = utils.QueryAllContents(state.Service())
-			if err != nil {
-				log.Fatalf("Failed to retrieve file list from Drive: %s\n", err)
-			}
-			log.Println("Retrieved file info from Drive")
+		// Run the watch loop to accumulate changes in the init period
+		go utils.WatchLoop(state)
+		go utils.PollLoop(state)
+
+		checksumCache, err := afs.LoadChecksumCache(config.ChecksumCachePath)
+		if err != nil {
+			log.Printf("Failed to load checksum cache, all files will be rehashed: %s\n", err)
+			checksumCache = nil
+		}
+		for account, remote := range remotes {
+			var dirs []backup.DirectoryTree
 			for _, dir := range config.Directories {
-				tree, err := afs.NewTreeFromDrive(driveFiles, dir.Remote)
-				if err != nil {
-					log.Fatalf("Failed to find drive tree rooted at %s corresponding to local tree at %s\n", dir.Remote, dir.Local)
+				if accountKey(dir.Account) == account {
+					localTree, _ := state.Tree(dir.Local)
+					dirs = append(dirs, backup.DirectoryTree{Local: localTree, RemoteName: dir.Remote})
 				}
-				driveTreesNames[dir.Local] = TreeName{tree, dir.Remote}
+			}
+			err = backup.Reconcile(dirs, remote, checksumCache)
+			if err != nil {
+				log.Fatalln(err)
 			}
 		}
+		saveChecksumCache(checksumCache)
 
-		// Attach the drive ID's to the local tree
-		for name := range driveTreesNames {
-			localTree, _ := state.Tree(name)
-			driveTree := driveTreesNames[name].tree
-			backup.AttachIDS(localTree, driveTree)
-			log.Printf("Attached ID's to tree with root path %s\n", localTree.RootPath())
+		go rescanLoop(state, config, checksumCache)
+		if reconcileInterval > 0 {
+			go reconcileLoop(state, reconcileInterval)
 		}
+		go utils.CoalesceEvents(state.FileEvents, state.DebouncedEvents, quietPeriods)
+		utils.ExecuteEvents(state)
+	},
+}
 
-		// Check if the local version of files is more recent than the drive version
-		for name := range driveTreesNames {
-			localTree, _ := state.Tree(name)
-			driveTree := driveTreesNames[name].tree
-			err := localTree.CalculateChecksums()
+// Connects to the account of each configured directory, and sets it as the remote
+// of the directory. Returns the remotes, by the key of their account name.
+func connectRemotes(state *utils.State, config config.Config) map[string]*utils.Remote {
+	remotes := make(map[string]*utils.Remote)
+	for _, dir := range config.Directories {
+		remote, ok := remotes[accountKey(dir.Account)]
+		if !ok {
+			auth, err := config.Account(dir.Account)
 			if err != nil {
-				log.Fatalf("Failed to calculate local tree checksums: %s\n", err)
+				log.Fatalf("Error in config file: %s\n", err)
 			}
-			log.Printf("Calculated checksums for tree rooted at %s\n", localTree.RootPath())
-			err = backup.UpdateDriveTree(localTree, driveTree, state.Service())
-			if err != nil {
-				log.Fatalf("Failed to update changed files for tree rooted at %s: %s\n", localTree.RootPath(), err)
+			readPassphrase(dir.Account, &auth)
+			service := utils.GetDriveService(auth)
+			remote = &utils.Remote{
+				Account:      dir.Account,
+				Service:      service,
+				RootFolderID: rootFolderID(service, auth.SharedDriveID, config.MachineIdentifier),
+				DriveID:      auth.SharedDriveID,
+				MachineID:    config.MachineIdentifier,
 			}
-			log.Printf("Updated to drive, tree rooted at %s\n", localTree.RootPath())
+			remotes[accountKey(dir.Account)] = remote
 		}
+		state.SetRemote(dir.Local, remote)
+	}
+	return remotes
+}
 
-		go utils.DebounceEvents(state.FileEvents, state.DebouncedEvents)
-		utils.ExecuteEvents(state)
-	},
+// Account names are case-insensitive, since viper lowercases the keys of accounts
+func accountKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// Returns the ID of the folder in Drive which holds the backed up directories of this machine,
+// which is found by its marker (or its name, if it was created by an earlier version).
+// If it does not exist, it is created at the top of the shared drive with the given ID,
+// or of My Drive if driveID is empty.
+func rootFolderID(service *drive.Service, driveID, machineIdentifier string) string {
+	rootFolder := fmt.Sprintf("piledriver-%s", machineIdentifier)
+	props := utils.MachineProperties(machineIdentifier)
+	rootFolderID, err := utils.AdoptFolder(service, driveID, "", rootFolder, props)
+	if errors.Is(err, utils.ErrNotFound) {
+		var parentID []string
+		if driveID != "" {
+			// The ID of a shared drive is also the ID of its top folder
+			parentID = append(parentID, driveID)
+		}
+		rootFolderID, err = utils.CreateMarkedFolder(service, rootFolder, props, parentID...)
+		if err != nil {
+			log.Fatalf("Failed to create rootFolder %s: %s\n", rootFolder, err)
+		}
+		log.Printf("Created %s as rootFolder\n", rootFolder)
+	} else if err != nil {
+		log.Fatalf("Failed to query rootFolder %s: %s\n", rootFolder, err)
+	}
+	return rootFolderID
+}
+
+// Logs the number of watches needed for each watched directory,
+// and warns if they exceed the limit
+func reportWatches(dirs []config.DirectoryConfig) {
+	total := 0
+	for _, dir := range dirs {
+		if dir.Poll {
+			continue
+		}
+		count := utils.CountWatches(dir.Local)
+		log.Printf("%s needs %d watches\n", dir.Local, count)
+		total += count
+	}
+	if max, ok := utils.MaxWatches(); ok && total > max {
+		log.Printf("%d watches are needed, but only %d are allowed (see fs.inotify.max_user_watches); "+
+			"directories which cannot be watched will be polled instead\n", total, max)
+	}
 }
 
 // Execute is the top-level command execute - call this from main
@@ -144,8 +183,10 @@ func Execute() error {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().IntVar(&passphraseFD, "passphrase-fd", -1, "read the passphrase of encrypted tokens from this file descriptor, for accounts without PILEDRIVER_PASSPHRASE_<ACCOUNT> set")
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(authCmd)
+	rootCmd.AddCommand(restoreCmd)
 }
 
 func initConfig() {
@@ -166,6 +207,7 @@ func initConfig() {
 	}
 
 	viper.SetDefault("tokenPath", path.Join(homedir, ".piledriver.token"))
+	viper.SetDefault("checksumCachePath", path.Join(homedir, ".piledriver.cache"))
 	const randomString string = "XcK2YkF8rkyCQRlX9qn9"
 	machineID, err := machineid.ProtectedID(randomString)
 	if err != nil {
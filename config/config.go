@@ -1,16 +1,61 @@
 package config
 
+import (
+	"fmt"
+	"strings"
+)
+
 // DirectoryConfig represents the config of a directory that must
 // be backed up
 type DirectoryConfig struct {
-	Local     string
-	Remote    string
-	Recursive bool
+	Local        string
+	Remote       string
+	Recursive    bool
+	Poll         bool   // Poll for changes instead of watching, for filesystems which do not report them
+	PollInterval string // Duration between polls, eg, "30s"
+	Account      string // Name of the account backed up to (the default account if empty)
+}
+
+// AuthConfig holds the config for authenticating with Google Drive,
+// and for the drive which is backed up to
+type AuthConfig struct {
+	TokenPath             string
+	ClientCredentialsPath string // OAuth client credentials JSON downloaded from the Google Cloud console (built-in client if empty)
+	Scope                 string // Either file (only files created by Piledriver, the default) or full
+	ServiceAccountKeyPath string // Key of a service account to authenticate as, instead of with a token
+	Subject               string // User for the service account to act as, by domain-wide delegation (optional)
+	EncryptToken          bool   // Encrypt the token file with a key derived from the passphrase (PILEDRIVER_PASSPHRASE_<ACCOUNT> for a named account) or key file
+	TokenKeyPath          string // File whose contents are used instead of a passphrase (optional)
+	Passphrase            string `mapstructure:"-"` // Never read from the config, but supplied at startup
+	SharedDriveID         string // ID of a shared drive to back up to, instead of My Drive
 }
 
 // Config holds all the config
 type Config struct {
+	AuthConfig        `mapstructure:",squash"` // The default account
+	Accounts          map[string]AuthConfig    // Map from name to any other accounts
 	Directories       []DirectoryConfig
-	TokenPath         string
 	MachineIdentifier string
+	ChecksumCachePath string
+	HashAlgorithm     string            // Either md5 or sha256
+	QuietPeriods      map[string]string // Map from event category to duration, eg, "fileWritten": "5s"
+	ReconcileInterval string            // Duration between periodic reconciliations, eg, "1h" (none if empty)
+}
+
+// Account returns the auth config of the account with the given name,
+// which is the default account if name is empty.
+// The token of an account without a tokenPath is stored next to that of the default account.
+func (config Config) Account(name string) (AuthConfig, error) {
+	if name == "" {
+		return config.AuthConfig, nil
+	}
+	// Keys are lowercased by viper
+	auth, ok := config.Accounts[strings.ToLower(name)]
+	if !ok {
+		return AuthConfig{}, fmt.Errorf("unknown account: %s", name)
+	}
+	if auth.TokenPath == "" && config.TokenPath != "" {
+		auth.TokenPath = fmt.Sprintf("%s-%s.token", strings.TrimSuffix(config.TokenPath, ".token"), strings.ToLower(name))
+	}
+	return auth, nil
 }
@@ -39,7 +39,37 @@ func TestSimpleConfig(t *testing.T) {
 	assert.Equal("/home/deep/.config", dir2.Local)
 	assert.Equal("config", dir2.Remote)
 	assert.False(dir2.Recursive)
+	assert.False(dir1.Poll)
+	assert.True(dir2.Poll)
+	assert.Equal("1m", dir2.PollInterval)
+	assert.Equal("", dir1.Account)
+	assert.Equal("Work", dir2.Account)
 
 	assert.Equal("/home/deep/.piledriver.token", config.TokenPath)
+	assert.Equal("/home/deep/client.json", config.ClientCredentialsPath)
+	assert.Equal("full", config.Scope)
+	assert.Equal("/home/deep/service.json", config.ServiceAccountKeyPath)
+	assert.Equal("deep@example.com", config.Subject)
+	assert.True(config.EncryptToken)
+	assert.Equal("0ABcdEFgh1ijKLmnOpq", config.SharedDriveID)
+
+	auth, err := config.Account("")
+	assert.NoError(err)
+	assert.Equal(config.AuthConfig, auth)
+	auth, err = config.Account(dir2.Account)
+	assert.NoError(err)
+	assert.Equal("/home/deep/.piledriver-work.token", auth.TokenPath)
+	assert.Equal("file", auth.Scope)
+	assert.Equal("", auth.SharedDriveID)
+	assert.Equal("", auth.ClientCredentialsPath)
+	auth, err = config.Account("personal")
+	assert.NoError(err)
+	assert.Equal("/home/deep/personal.token", auth.TokenPath)
+	assert.Equal("/home/deep/personal-client.json", auth.ClientCredentialsPath)
+	_, err = config.Account("school")
+	assert.Error(err)
+
 	assert.Equal("SillyMachine", config.MachineIdentifier)
+	assert.Equal(map[string]string{"filewritten": "5s"}, config.QuietPeriods)
+	assert.Equal("30m", config.ReconcileInterval)
 }
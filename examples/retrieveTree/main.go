@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/config"
 	"github.com/RedDocMD/piledriver/utils"
 )
 
@@ -16,9 +17,9 @@ func main() {
 	}
 	homedirParts := afs.SplitPathPlatform(homedir)
 	tokenPath := afs.JoinPathPlatform(append(homedirParts, []string{".config", ".piledriver.token"}...), true)
-	service := utils.GetDriveService(tokenPath)
+	service := utils.GetDriveService(config.AuthConfig{TokenPath: tokenPath})
 
-	files, err := utils.QueryAllContents(service)
+	files, err := utils.QueryAllContents(service, "")
 	if err != nil {
 		log.Fatalln("Failed to retrieve file list:", err)
 	}
@@ -26,7 +27,7 @@ func main() {
 		fmt.Printf("%s => %s (parent = %s, mimeType = %s)\n", file.Name, file.Id, file.Parents[0], file.MimeType)
 	}
 
-	tree, err := afs.NewTreeFromDrive(files, "tree_dir")
+	tree, err := afs.NewTreeFromDrive(files, "tree_dir", afs.MD5)
 	if err != nil {
 		fmt.Printf("Failed to convert drive contents to tree: %s", err)
 	}
@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 
 	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/config"
 	"github.com/RedDocMD/piledriver/utils"
 )
 
@@ -18,7 +19,7 @@ func main() {
 	}
 	homedirParts := afs.SplitPathPlatform(homedir)
 	tokenPath := afs.JoinPathPlatform(append(homedirParts, []string{".config", ".piledriver.token"}...), true)
-	service := utils.GetDriveService(tokenPath)
+	service := utils.GetDriveService(config.AuthConfig{TokenPath: tokenPath})
 
 	parentID := make(map[string]string)
 
@@ -34,7 +35,7 @@ func main() {
 			}
 		} else {
 			parent := parentID[parentPath]
-			id, err = utils.CreateFile(service, path, parent)
+			id, err = utils.CreateFile(service, path, parent, afs.MD5)
 		}
 		parentID[path] = id
 		if err != nil {
@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/RedDocMD/piledriver/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+const deviceCodeURL = "https://oauth2.googleapis.com/device/code"
+
+// OAuthConfig returns the OAuth 2.0 config given by auth, redirecting to redirectURL (if any).
+// The client is read from auth.ClientCredentialsPath, if it is set.
+func OAuthConfig(auth config.AuthConfig, redirectURL string) (*oauth2.Config, error) {
+	scope, err := parseScope(auth.Scope)
+	if err != nil {
+		return nil, err
+	}
+	if auth.ClientCredentialsPath == "" {
+		return &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       []string{scope},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+				TokenURL: "https://oauth2.googleapis.com/token",
+			},
+			RedirectURL: redirectURL,
+		}, nil
+	}
+
+	data, err := ioutil.ReadFile(auth.ClientCredentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := google.ConfigFromJSON(data, scope)
+	if err != nil {
+		return nil, err
+	}
+	conf.RedirectURL = redirectURL
+	return conf, nil
+}
+
+// Returns a token source for the service account whose key is at auth.ServiceAccountKeyPath.
+// If auth.Subject is set, the service account acts as that user, which requires
+// domain-wide delegation to be granted to it.
+func serviceAccountTokenSource(ctx context.Context, auth config.AuthConfig) (oauth2.TokenSource, error) {
+	scope, err := parseScope(auth.Scope)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(auth.ServiceAccountKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := google.JWTConfigFromJSON(data, scope)
+	if err != nil {
+		return nil, err
+	}
+	conf.Subject = auth.Subject
+	return conf.TokenSource(ctx), nil
+}
+
+// Returns the Drive scope with the given name
+func parseScope(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", "file":
+		return drive.DriveFileScope, nil
+	case "full":
+		return drive.DriveScope, nil
+	default:
+		return "", fmt.Errorf("unknown scope: %s", name)
+	}
+}
+
+// Returns the OAuth 2.0 config given by auth, exiting if it is invalid
+func mustOAuthConfig(auth config.AuthConfig, redirectURL string) *oauth2.Config {
+	conf, err := OAuthConfig(auth, redirectURL)
+	if err != nil {
+		log.Fatalf("Invalid OAuth client config: %s\n", err)
+	}
+	return conf
+}
+
+// AuthorizeDevice authenticates Piledriver with the OAuth 2.0 device authorization grant,
+// for machines without a browser: the user enters the code it prints on any other device
+func AuthorizeDevice(auth config.AuthConfig) {
+	if err := checkDeviceAuth(auth); err != nil {
+		log.Fatalf("Cannot authenticate with a device code: %s\n", err)
+	}
+	conf := mustOAuthConfig(auth, "")
+	ctx := context.Background()
+
+	device, err := requestDeviceCode(ctx, deviceCodeURL, conf)
+	if err != nil {
+		log.Fatalf("Failed to request device code: %s\n", err)
+	}
+	fmt.Printf("Visit %s on any device and enter the code:\n%s\n\n", device.VerificationURL, device.UserCode)
+
+	tok, err := pollDeviceToken(ctx, conf, device)
+	if err != nil {
+		log.Fatalf("Failed to get token: %s\n", err)
+	}
+	saveToken(auth, tok)
+}
+
+// Returns why auth cannot be used with the device authorization grant. Google only allows it
+// for clients of the "TVs and Limited Input devices" type, which the built-in client is not,
+// and for a limited set of scopes, which includes the file scope but not the full one.
+func checkDeviceAuth(auth config.AuthConfig) error {
+	if auth.ClientCredentialsPath == "" {
+		return errors.New(`"clientCredentialsPath" must be set to a client of the "TVs and Limited Input devices" type`)
+	}
+	scope, err := parseScope(auth.Scope)
+	if err != nil {
+		return err
+	}
+	if scope == drive.DriveScope {
+		return errors.New(`scope "full" is not allowed, use --manual instead`)
+	}
+	return nil
+}
+
+// AuthorizeManual authenticates Piledriver by having the user open the authentication URL
+// in a browser on any machine, and paste back the URL it redirects to (which fails to load,
+// unless it is on the same machine)
+func AuthorizeManual(auth config.AuthConfig) {
+	conf := mustOAuthConfig(auth, fmt.Sprintf("http://127.0.0.1:%d", redirectPort))
+	state, err := randomState()
+	if err != nil {
+		log.Fatalf("Error while generating CSRF token: %s\n", err)
+	}
+	verifier, challenge, err := pkcePair()
+	if err != nil {
+		log.Fatalf("Error while generating PKCE verifier: %s\n", err)
+	}
+
+	url := conf.AuthCodeURL(state, oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", challenge),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	fmt.Printf("Open the following URL in your browser:\n%s\n\n", url)
+	fmt.Print("Paste the URL of the page it redirects to (or just the code in it): ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatalf("Failed to read the URL: %s\n", err)
+	}
+	code, err := codeFromRedirect(strings.TrimSpace(line), state)
+	if err != nil {
+		log.Fatalf("Failed to authenticate: %s\n", err)
+	}
+
+	tok, err := conf.Exchange(context.Background(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		log.Fatalf("Failed to get token\n")
+	}
+	saveToken(auth, tok)
+}
+
+// Returns the authorization code in input, which is either the URL redirected to
+// after authentication, or the code itself
+func codeFromRedirect(input, state string) (string, error) {
+	if !strings.Contains(input, "?") {
+		if input == "" {
+			return "", errors.New("no code given")
+		}
+		return input, nil
+	}
+	redirect, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	query := redirect.Query()
+	if reason := query.Get("error"); reason != "" {
+		return "", errors.New(reason)
+	}
+	if query.Get("state") != state {
+		return "", errors.New("state does not match, the URL is not from this authentication")
+	}
+	code := query.Get("code")
+	if code == "" {
+		return "", errors.New("no code in URL")
+	}
+	return code, nil
+}
+
+// Response to a device authorization request
+type deviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+func requestDeviceCode(ctx context.Context, codeURL string, conf *oauth2.Config) (*deviceCode, error) {
+	form := url.Values{
+		"client_id": {conf.ClientID},
+		"scope":     {strings.Join(conf.Scopes, " ")},
+	}
+	var device deviceCode
+	if err := postForm(ctx, codeURL, form, &device); err != nil {
+		return nil, err
+	}
+	if device.Interval <= 0 {
+		device.Interval = 5
+	}
+	return &device, nil
+}
+
+// Polls the token endpoint until the user has entered the device code, or it expires
+func pollDeviceToken(ctx context.Context, conf *oauth2.Config, device *deviceCode) (*oauth2.Token, error) {
+	form := url.Values{
+		"client_id":     {conf.ClientID},
+		"client_secret": {conf.ClientSecret},
+		"device_code":   {device.DeviceCode},
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+	}
+	interval := time.Duration(device.Interval) * time.Second
+	expiry := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for time.Now().Before(expiry) {
+		time.Sleep(interval)
+		var resp struct {
+			AccessToken  string `json:"access_token"`
+			RefreshToken string `json:"refresh_token"`
+			TokenType    string `json:"token_type"`
+			ExpiresIn    int    `json:"expires_in"`
+		}
+		err := postForm(ctx, conf.Endpoint.TokenURL, form, &resp)
+		var oauthErr *oauthError
+		switch {
+		case errors.As(err, &oauthErr) && oauthErr.Code == "authorization_pending":
+			continue
+		case errors.As(err, &oauthErr) && oauthErr.Code == "slow_down":
+			interval += 5 * time.Second
+			continue
+		case err != nil:
+			return nil, err
+		}
+		return &oauth2.Token{
+			AccessToken:  resp.AccessToken,
+			RefreshToken: resp.RefreshToken,
+			TokenType:    resp.TokenType,
+			Expiry:       time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+		}, nil
+	}
+	return nil, errors.New("the device code expired before it was entered")
+}
+
+// Error returned by an OAuth 2.0 endpoint
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (err *oauthError) Error() string {
+	if err.Description != "" {
+		return fmt.Sprintf("%s: %s", err.Code, err.Description)
+	}
+	return err.Code
+}
+
+// Posts form to endpoint and decodes the JSON response into result.
+// An error response is returned as an *oauthError.
+func postForm(ctx context.Context, endpoint string, form url.Values, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		oauthErr := &oauthError{}
+		if err := json.NewDecoder(resp.Body).Decode(oauthErr); err != nil || oauthErr.Code == "" {
+			return fmt.Errorf("%s returned %s", endpoint, resp.Status)
+		}
+		return oauthErr
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RedDocMD/piledriver/config"
+	"github.com/alecthomas/assert"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestCodeFromRedirect(t *testing.T) {
+	assert := assert.New(t)
+
+	code, err := codeFromRedirect("http://127.0.0.1:4598/?state=xyz&code=abc&scope=s", "xyz")
+	assert.NoError(err)
+	assert.Equal("abc", code)
+
+	code, err = codeFromRedirect("abc", "xyz")
+	assert.NoError(err)
+	assert.Equal("abc", code)
+
+	_, err = codeFromRedirect("http://127.0.0.1:4598/?state=other&code=abc", "xyz")
+	assert.Error(err)
+	_, err = codeFromRedirect("http://127.0.0.1:4598/?state=xyz&error=access_denied", "xyz")
+	assert.EqualError(err, "access_denied")
+}
+
+func TestPollDeviceToken(t *testing.T) {
+	assert := assert.New(t)
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(r.ParseForm())
+		assert.Equal("device", r.PostForm.Get("device_code"))
+		polls++
+		if polls == 1 {
+			w.WriteHeader(http.StatusPreconditionRequired)
+			fmt.Fprint(w, `{"error": "authorization_pending"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+
+	conf := mustOAuthConfig(config.AuthConfig{}, "")
+	conf.Endpoint.TokenURL = server.URL
+	tok, err := pollDeviceToken(context.Background(), conf, &deviceCode{DeviceCode: "device", ExpiresIn: 60})
+	assert.NoError(err)
+	assert.Equal(2, polls)
+	assert.Equal("access", tok.AccessToken)
+	assert.Equal("refresh", tok.RefreshToken)
+}
+
+func TestPollDeviceTokenDenied(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error": "access_denied", "error_description": "denied by user"}`)
+	}))
+	defer server.Close()
+
+	conf := mustOAuthConfig(config.AuthConfig{}, "")
+	conf.Endpoint.TokenURL = server.URL
+	_, err := pollDeviceToken(context.Background(), conf, &deviceCode{DeviceCode: "device", ExpiresIn: 60})
+	assert.EqualError(t, err, "access_denied: denied by user")
+}
+
+func TestServeOAuthRedirect(t *testing.T) {
+	assert := assert.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, server := serveOAuthRedirect(listener, "xyz")
+	defer server.Close()
+	base := "http://" + listener.Addr().String()
+
+	// A request without the right state is rejected
+	resp, err := http.Get(base + "/?state=other&code=forged")
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(0, len(results))
+
+	resp, err = http.Get(base + "/?state=xyz&code=abc")
+	assert.NoError(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	result := <-results
+	assert.NoError(result.err)
+	assert.Equal("abc", result.code)
+}
+
+func TestPKCEPair(t *testing.T) {
+	verifier, challenge, err := pkcePair()
+	assert.NoError(t, err)
+	assert.Equal(t, 43, len(verifier))
+	sum := sha256.Sum256([]byte(verifier))
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(sum[:]), challenge)
+}
+
+func TestOAuthConfig(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credentials := filepath.Join(dir, "client.json")
+	err = ioutil.WriteFile(credentials, []byte(`{"installed": {
+		"client_id": "my-client", "client_secret": "my-secret",
+		"auth_uri": "https://accounts.google.com/o/oauth2/auth",
+		"token_uri": "https://oauth2.googleapis.com/token",
+		"redirect_uris": ["http://localhost"]}}`), 0600)
+	assert.NoError(err)
+
+	conf, err := OAuthConfig(config.AuthConfig{ClientCredentialsPath: credentials, Scope: "full"}, "http://127.0.0.1:1234")
+	assert.NoError(err)
+	assert.Equal("my-client", conf.ClientID)
+	assert.Equal("my-secret", conf.ClientSecret)
+	assert.Equal([]string{drive.DriveScope}, conf.Scopes)
+	assert.Equal("http://127.0.0.1:1234", conf.RedirectURL)
+
+	conf, err = OAuthConfig(config.AuthConfig{}, "")
+	assert.NoError(err)
+	assert.Equal(clientID, conf.ClientID)
+	assert.Equal([]string{drive.DriveFileScope}, conf.Scopes)
+
+	_, err = OAuthConfig(config.AuthConfig{Scope: "everything"}, "")
+	assert.Error(err)
+}
+
+func TestCheckDeviceAuth(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(checkDeviceAuth(config.AuthConfig{ClientCredentialsPath: "client.json"}))
+	assert.NoError(checkDeviceAuth(config.AuthConfig{ClientCredentialsPath: "client.json", Scope: "file"}))
+	// The built-in client is not a device client
+	assert.Error(checkDeviceAuth(config.AuthConfig{}))
+	assert.Error(checkDeviceAuth(config.AuthConfig{ClientCredentialsPath: "client.json", Scope: "full"}))
+}
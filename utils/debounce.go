@@ -1,33 +1,257 @@
 package utils
 
 import (
+	"fmt"
+	"strings"
 	"time"
+
+	"github.com/RedDocMD/piledriver/afs"
 )
 
-// DebounceEvents removes identical events less than some threshold.
-func DebounceEvents(input, output chan Event) {
-	const threshold = 500 // ms
+// DefaultQuietPeriods returns the default quiet period for each category of event
+func DefaultQuietPeriods() [MaxEventCategory]time.Duration {
+	var periods [MaxEventCategory]time.Duration
+	for i := range periods {
+		periods[i] = 500 * time.Millisecond
+	}
+	periods[FileCreated] = 2 * time.Second
+	periods[FileWritten] = 2 * time.Second
+	return periods
+}
 
-	// There is one map for each Category of Event
-	var lastEvent [MaxEventCategory]map[string]time.Time
-	for i := range lastEvent {
-		lastEvent[i] = make(map[string]time.Time)
+// ParseQuietPeriods returns the default quiet periods, overridden by those
+// given in periods. The keys of periods are names of event categories, as
+// accepted by ParseEventCategory, and the values are durations, as accepted
+// by time.ParseDuration.
+func ParseQuietPeriods(periods map[string]string) ([MaxEventCategory]time.Duration, error) {
+	quiet := DefaultQuietPeriods()
+	for name, value := range periods {
+		cat, err := ParseEventCategory(name)
+		if err != nil {
+			return quiet, err
+		}
+		period, err := time.ParseDuration(value)
+		if err != nil {
+			return quiet, fmt.Errorf("invalid quiet period for %s: %s", name, err)
+		}
+		quiet[cat] = period
 	}
+	return quiet, nil
+}
+
+// CoalesceEvents forwards events from input to output, only after there have been no
+// further events for their path for the quiet period of their category.
+// Events for the same path are merged in the meantime:
+//   - a create followed by writes becomes a create
+//   - a create followed by a delete cancels out, along with events inside a created directory
+//   - repeated writes collapse into one
+//   - a write followed by a delete becomes a delete
+//   - a change of metadata is absorbed by a create or write of the same file
+//   - a create or rename followed by a rename becomes a create or rename to the final path
+//
+// Events are forwarded in the order they were received, except that an event
+// need not wait for a pending event which is unrelated to it (ie, on a path which is
+// neither the same as, nor an ancestor or descendant of, its own).
+// When input is closed, all pending events are forwarded.
+func CoalesceEvents(input, output chan Event, quietPeriods [MaxEventCategory]time.Duration) {
+	c := newCoalescer(quietPeriods)
+	for {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if deadline, ok := c.nextDeadline(time.Now()); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
 
-	for event := range input {
-		cat := event.Category
-		path := event.Path
-		currTime := event.Timestamp
-		lastTime, ok := lastEvent[cat][path]
-		if !ok {
-			lastEvent[cat][path] = currTime
+		select {
+		case event, ok := <-input:
+			if !ok {
+				for _, pending := range c.pending {
+					output <- pending.event
+				}
+				return
+			}
+			c.add(event, time.Now())
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		for _, event := range c.ready(time.Now()) {
 			output <- event
+		}
+	}
+}
+
+type pendingEvent struct {
+	event    Event
+	deadline time.Time
+}
+
+// Holds the events which have not yet been forwarded
+type coalescer struct {
+	quiet   [MaxEventCategory]time.Duration
+	pending []*pendingEvent // In order of arrival
+}
+
+func newCoalescer(quietPeriods [MaxEventCategory]time.Duration) *coalescer {
+	return &coalescer{quiet: quietPeriods}
+}
+
+// Adds an event received at time now, merging it with a pending event if possible
+func (c *coalescer) add(event Event, now time.Time) {
+	deadline := now.Add(c.quiet[event.Category])
+	isRename := event.Category == FileRenamed || event.Category == DirectoryRenamed
+
+	if isRename {
+		// Pending events (of descendants too) must refer to the path
+		// the tree has now, since that is what they will be executed against
+		for _, pending := range c.pending {
+			pending.event.Path = replacePathPrefix(pending.event.Path, event.OldPath, event.Path)
+			if pending.event.Category == FileRenamed || pending.event.Category == DirectoryRenamed {
+				pending.event.OldPath = replacePathPrefix(pending.event.OldPath, event.OldPath, event.Path)
+			}
+		}
+	}
+
+	idx := c.lastPendingFor(event.Path)
+	if idx == -1 {
+		c.pending = append(c.pending, &pendingEvent{event: event, deadline: deadline})
+		return
+	}
+	pending := c.pending[idx]
+	prev := pending.event.Category
+	curr := event.Category
+	extend := func() {
+		if deadline.After(pending.deadline) {
+			pending.deadline = deadline
+		}
+		// The merged event must not be dropped as stale if the later one is not
+		if event.Generation > pending.event.Generation {
+			pending.event.Generation = event.Generation
+		}
+	}
+
+	switch {
+	case isRename && (prev == FileCreated || prev == DirectoryCreated):
+		// The path of the created file has already been rewritten
+		extend()
+	case isRename && (prev == FileRenamed || prev == DirectoryRenamed) && pending.event.OldPath == pending.event.Path:
+		// Renamed back to where it started from
+		c.remove(idx)
+	case isRename && (prev == FileRenamed || prev == DirectoryRenamed):
+		extend()
+	case prev == FileCreated && curr == FileDeleted:
+		c.remove(idx)
+	case prev == DirectoryCreated && curr == DirectoryDeleted:
+		// Whatever happened inside the directory is gone along with it
+		c.removeDescendants(idx, event.Path)
+		c.remove(idx)
+	case prev == FileCreated && curr == FileWritten:
+		extend()
+	case (prev == FileWritten || prev == MetadataChanged) && curr == FileDeleted:
+		pending.event = event
+		pending.deadline = deadline
+	case (prev == FileCreated || prev == FileWritten) && curr == MetadataChanged:
+		// Uploading the contents updates the metadata as well
+		extend()
+	case prev == MetadataChanged && curr == FileWritten:
+		pending.event = event
+		pending.deadline = deadline
+	case prev == curr && !isRename:
+		pending.event.Timestamp = event.Timestamp
+		extend()
+	default:
+		c.pending = append(c.pending, &pendingEvent{event: event, deadline: deadline})
+	}
+}
+
+// Returns the events which are ready to be forwarded at time now
+// and removes them from the pending list
+func (c *coalescer) ready(now time.Time) []Event {
+	var ready []Event
+	var remaining []*pendingEvent
+	for _, pending := range c.pending {
+		blocked := now.Before(pending.deadline)
+		for _, earlier := range remaining {
+			if blocked {
+				break
+			}
+			blocked = eventsRelated(earlier.event, pending.event)
+		}
+		if blocked {
+			remaining = append(remaining, pending)
 		} else {
-			timeGap := currTime.Sub(lastTime)
-			if timeGap.Milliseconds() > threshold {
-				lastEvent[cat][path] = currTime
-				output <- event
+			ready = append(ready, pending.event)
+		}
+	}
+	c.pending = remaining
+	return ready
+}
+
+// Returns the earliest deadline after now of the pending events, if there are any.
+// Events whose deadline has passed are only pending because they are blocked
+// by an earlier event, whose deadline is yet to come.
+func (c *coalescer) nextDeadline(now time.Time) (time.Time, bool) {
+	var next time.Time
+	found := false
+	for _, pending := range c.pending {
+		if pending.deadline.After(now) && (!found || pending.deadline.Before(next)) {
+			next = pending.deadline
+			found = true
+		}
+	}
+	return next, found
+}
+
+// Returns the index of the last pending event on path, or -1 if there is none
+func (c *coalescer) lastPendingFor(path string) int {
+	for i := len(c.pending) - 1; i >= 0; i-- {
+		if c.pending[i].event.Path == path {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *coalescer) remove(idx int) {
+	c.pending = append(c.pending[:idx], c.pending[idx+1:]...)
+}
+
+// Removes the pending events after idx on paths inside dir
+func (c *coalescer) removeDescendants(idx int, dir string) {
+	kept := c.pending[:idx+1]
+	for _, pending := range c.pending[idx+1:] {
+		if pending.event.Path == dir || !afs.IsSubPath(pending.event.Path, dir) {
+			kept = append(kept, pending)
+		}
+	}
+	c.pending = kept
+}
+
+// Two events are related if one's paths are the same as, or ancestors of, the other's
+func eventsRelated(first, second Event) bool {
+	paths := func(ev Event) []string {
+		if ev.Category == FileRenamed || ev.Category == DirectoryRenamed {
+			return []string{ev.Path, ev.OldPath}
+		}
+		return []string{ev.Path}
+	}
+	for _, firstPath := range paths(first) {
+		for _, secondPath := range paths(second) {
+			if afs.IsSubPath(firstPath, secondPath) || afs.IsSubPath(secondPath, firstPath) {
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// If path lies inside oldDir, returns the same path inside newDir
+func replacePathPrefix(path, oldDir, newDir string) string {
+	if path == "" || !afs.IsSubPath(path, oldDir) {
+		return path
+	}
+	return newDir + strings.TrimPrefix(path, oldDir)
 }
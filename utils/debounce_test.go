@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+)
+
+func testQuietPeriods() [MaxEventCategory]time.Duration {
+	var periods [MaxEventCategory]time.Duration
+	for i := range periods {
+		periods[i] = time.Second
+	}
+	return periods
+}
+
+func testPath(path string) string {
+	return filepath.FromSlash(path)
+}
+
+func TestCoalesceWaitsForQuiescence(t *testing.T) {
+	assert := assert.New(t)
+	c := newCoalescer(testQuietPeriods())
+	start := time.Now()
+	path := testPath("/dir/file")
+
+	c.add(Event{Path: path, Category: FileWritten}, start)
+	c.add(Event{Path: path, Category: FileWritten}, start.Add(800*time.Millisecond))
+	assert.Equal(0, len(c.ready(start.Add(1500*time.Millisecond))))
+	ready := c.ready(start.Add(1800 * time.Millisecond))
+	assert.Equal([]Event{{Path: path, Category: FileWritten}}, ready)
+	_, ok := c.nextDeadline(start.Add(1800 * time.Millisecond))
+	assert.False(ok)
+}
+
+func TestCoalesceMerges(t *testing.T) {
+	assert := assert.New(t)
+	c := newCoalescer(testQuietPeriods())
+	now := time.Now()
+	created := testPath("/dir/created")
+	temp := testPath("/dir/temp")
+	deleted := testPath("/dir/deleted")
+
+	c.add(Event{Path: created, Category: FileCreated}, now)
+	c.add(Event{Path: created, Category: FileWritten}, now)
+	c.add(Event{Path: temp, Category: FileCreated}, now)
+	c.add(Event{Path: temp, Category: FileDeleted}, now)
+	c.add(Event{Path: deleted, Category: FileWritten}, now)
+	c.add(Event{Path: deleted, Category: FileDeleted, IDMap: map[IDKey]string{CurrID: "id"}}, now)
+
+	ready := c.ready(now.Add(time.Second))
+	assert.Equal([]Event{
+		{Path: created, Category: FileCreated},
+		{Path: deleted, Category: FileDeleted, IDMap: map[IDKey]string{CurrID: "id"}},
+	}, ready)
+}
+
+func TestCoalesceCancelledDirectory(t *testing.T) {
+	assert := assert.New(t)
+	c := newCoalescer(testQuietPeriods())
+	now := time.Now()
+	dir := testPath("/dir/temp")
+	other := testPath("/dir/tempfile")
+
+	c.add(Event{Path: dir, Category: DirectoryCreated}, now)
+	c.add(Event{Path: testPath("/dir/temp/sub"), Category: DirectoryCreated}, now)
+	c.add(Event{Path: testPath("/dir/temp/sub/file"), Category: FileCreated}, now)
+	c.add(Event{Path: testPath("/dir/temp/sub/file"), Category: MetadataChanged}, now)
+	c.add(Event{Path: other, Category: FileWritten}, now)
+	c.add(Event{Path: dir, Category: DirectoryDeleted}, now)
+
+	ready := c.ready(now.Add(time.Second))
+	assert.Equal([]Event{{Path: other, Category: FileWritten}}, ready)
+}
+
+func TestCoalesceMetadataChanges(t *testing.T) {
+	assert := assert.New(t)
+	c := newCoalescer(testQuietPeriods())
+	now := time.Now()
+	written := testPath("/dir/written")
+	chmodded := testPath("/dir/chmodded")
+
+	c.add(Event{Path: written, Category: MetadataChanged}, now)
+	c.add(Event{Path: written, Category: FileWritten}, now)
+	c.add(Event{Path: written, Category: MetadataChanged}, now)
+	c.add(Event{Path: chmodded, Category: MetadataChanged}, now)
+	c.add(Event{Path: chmodded, Category: MetadataChanged}, now)
+
+	ready := c.ready(now.Add(time.Second))
+	assert.Equal([]Event{
+		{Path: written, Category: FileWritten},
+		{Path: chmodded, Category: MetadataChanged},
+	}, ready)
+}
+
+func TestCoalesceRenames(t *testing.T) {
+	assert := assert.New(t)
+	c := newCoalescer(testQuietPeriods())
+	now := time.Now()
+
+	c.add(Event{Path: testPath("/dir/a"), Category: FileCreated}, now)
+	c.add(Event{Path: testPath("/dir/b"), OldPath: testPath("/dir/a"), Category: FileRenamed}, now)
+	c.add(Event{Path: testPath("/dir/sub/c"), Category: FileWritten}, now)
+	c.add(Event{Path: testPath("/dir/new"), OldPath: testPath("/dir/sub"), Category: DirectoryRenamed}, now)
+
+	ready := c.ready(now.Add(time.Second))
+	assert.Equal([]Event{
+		{Path: testPath("/dir/b"), Category: FileCreated},
+		{Path: testPath("/dir/new/c"), Category: FileWritten},
+		{Path: testPath("/dir/new"), OldPath: testPath("/dir/sub"), Category: DirectoryRenamed},
+	}, ready)
+
+	c.add(Event{Path: testPath("/dir/y"), OldPath: testPath("/dir/x"), Category: FileRenamed}, now)
+	c.add(Event{Path: testPath("/dir/x"), OldPath: testPath("/dir/y"), Category: FileRenamed}, now)
+	assert.Equal(0, len(c.pending))
+}
+
+func TestCoalescePreservesOrderOfRelatedEvents(t *testing.T) {
+	assert := assert.New(t)
+	periods := testQuietPeriods()
+	periods[DirectoryCreated] = 3 * time.Second
+	c := newCoalescer(periods)
+	now := time.Now()
+
+	c.add(Event{Path: testPath("/dir/sub"), Category: DirectoryCreated}, now)
+	c.add(Event{Path: testPath("/dir/sub/file"), Category: FileCreated}, now)
+	c.add(Event{Path: testPath("/dir/other"), Category: FileCreated}, now)
+
+	// The file inside the new directory waits for it, the unrelated one does not
+	ready := c.ready(now.Add(time.Second))
+	assert.Equal([]Event{{Path: testPath("/dir/other"), Category: FileCreated}}, ready)
+	deadline, ok := c.nextDeadline(now.Add(time.Second))
+	assert.True(ok)
+	assert.Equal(now.Add(3*time.Second), deadline)
+
+	ready = c.ready(now.Add(3 * time.Second))
+	assert.Equal([]Event{
+		{Path: testPath("/dir/sub"), Category: DirectoryCreated},
+		{Path: testPath("/dir/sub/file"), Category: FileCreated},
+	}, ready)
+}
+
+func TestParseQuietPeriods(t *testing.T) {
+	assert := assert.New(t)
+	periods, err := ParseQuietPeriods(map[string]string{"filewritten": "5s"})
+	assert.NoError(err)
+	assert.Equal(5*time.Second, periods[FileWritten])
+	assert.Equal(DefaultQuietPeriods()[FileDeleted], periods[FileDeleted])
+
+	_, err = ParseQuietPeriods(map[string]string{"fileExploded": "5s"})
+	assert.Error(err)
+	_, err = ParseQuietPeriods(map[string]string{"fileWritten": "soon"})
+	assert.Error(err)
+}
@@ -5,17 +5,23 @@ import (
 	"context"
 	"crypto/md5"
 	"crypto/rand"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/config"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
@@ -78,39 +84,36 @@ const failureResponse = `
 </html>
 `
 
-// GetDriveService reads the token from the file denoted by tokenLocation
+// GetDriveService reads the token from the file denoted by auth.TokenPath
 // and then returns the Google Drive service. If it cannot find the token file,
 // it errors out and stops the program.
-func GetDriveService(tokenLocation string) *drive.Service {
-	tok, err := tokenFromFile(tokenLocation)
-	if err != nil {
-		log.Fatalf("Piledriver has not been authenticated: please run \"piledriver auth\"\n")
-	}
-
+// If auth.ServiceAccountKeyPath is set, the service account is used instead of the token.
+func GetDriveService(auth config.AuthConfig) *drive.Service {
 	ctx := context.Background()
 
-	conf := &oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		Scopes:       []string{drive.DriveFileScope},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://oauth2.googleapis.com/token",
-		},
-	}
-	restoredToken := &oauth2.Token{
-		AccessToken:  tok.AccessToken,
-		RefreshToken: tok.RefreshToken,
-		Expiry:       tok.Expiry,
-		TokenType:    tok.TokenType,
-	}
-	tokenSource := conf.TokenSource(ctx, restoredToken)
-	httpClient := oauth2.NewClient(ctx, tokenSource)
-	_, err = tokenSource.Token()
-	if err != nil {
-		if !strings.Contains(err.Error(), "failure in name resolution") {
+	var httpClient *http.Client
+	if auth.ServiceAccountKeyPath != "" {
+		tokenSource, err := serviceAccountTokenSource(ctx, auth)
+		if err != nil {
+			log.Fatalf("Invalid service account config: %s\n", err)
+		}
+		if _, err = tokenSource.Token(); err != nil {
+			log.Fatalf("Failed to startup Piledriver: %s\n", err)
+		}
+		httpClient = oauth2.NewClient(ctx, tokenSource)
+	} else {
+		store := mustTokenStore(auth)
+		tok, err := store.load()
+		if os.IsNotExist(err) {
 			log.Fatalf("Piledriver has not been authenticated: please run \"piledriver auth\"\n")
-		} else {
+		} else if err != nil {
+			log.Fatalf("Failed to read token: %s\n", err)
+		}
+		conf := mustOAuthConfig(auth, "")
+		tokenSource := newSavingTokenSource(ctx, conf, tok, store)
+		httpClient = tokenSource.client()
+		// A revoked token makes this wait for re-authentication, rather than fail
+		if _, err = tokenSource.Token(); err != nil {
 			log.Fatalf("Failed to startup Piledriver: %s\n", err)
 		}
 	}
@@ -122,116 +125,155 @@ func GetDriveService(tokenLocation string) *drive.Service {
 }
 
 // AuthorizeApp triggers the OAuth 2.0 web authentication
-// for Piledriver
-func AuthorizeApp(tokenLocation string) {
+// for Piledriver. The redirect is received by a server on the loopback interface,
+// which only lives until then (or until authTimeout).
+func AuthorizeApp(auth config.AuthConfig) {
 	ctx := context.Background()
 
-	redirectPath := "http://127.0.0.1"
-	redirectPort := 4598
-
-	conf := &oauth2.Config{
-		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		Scopes:       []string{drive.DriveFileScope},
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://oauth2.googleapis.com/token",
-		},
-		RedirectURL: fmt.Sprintf("%s:%d", redirectPath, redirectPort),
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("Failed to listen for the redirect: %s\n", err)
 	}
+	conf := mustOAuthConfig(auth, "http://"+listener.Addr().String())
 
-	randLim := big.NewInt(1)
-	randLim.Lsh(randLim, 200)
-	csrfVal, err := rand.Int(rand.Reader, randLim)
+	state, err := randomState()
 	if err != nil {
 		log.Fatalf("Error while generating CSRF token: %s\n", err)
 	}
+	verifier, challenge, err := pkcePair()
+	if err != nil {
+		log.Fatalf("Error while generating PKCE verifier: %s\n", err)
+	}
 
-	url := conf.AuthCodeURL(fmt.Sprint(csrfVal), oauth2.AccessTypeOffline)
+	url := conf.AuthCodeURL(state, oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", challenge),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
 	fmt.Printf("Open the following URL in your browser:\n%s\n\n", url)
 
-	var wg sync.WaitGroup
-	authChan := make(chan map[string]string)
-	go handleOAuthRedirect(redirectPort, &wg, &authChan)
-	ans := <-authChan
+	results, server := serveOAuthRedirect(listener, state)
+	var result redirectResult
+	select {
+	case result = <-results:
+	case <-time.After(authTimeout):
+		result.err = fmt.Errorf("timed out after %s", authTimeout)
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	server.Shutdown(shutdownCtx)
+	cancel()
 
-	var code string
-	if val, ok := ans["code"]; ok {
-		code = val
-	} else if val, ok := ans["error"]; ok {
+	if result.err != nil {
 		fmt.Println("Failed to authenticate!")
-		fmt.Println("Reason:", val)
-		os.Exit(1)
-	} else {
-		fmt.Println("Something unexpected happened while authenticating")
+		fmt.Println("Reason:", result.err)
 		os.Exit(1)
 	}
 
-	tok, err := conf.Exchange(ctx, code)
+	tok, err := conf.Exchange(ctx, result.code, oauth2.SetAuthURLParam("code_verifier", verifier))
 	if err != nil {
 		log.Fatalf("Failed to get token\n")
 	}
-	saveToken(tokenLocation, tok)
+	saveToken(auth, tok)
+}
+
+// Time allowed for the user to authenticate in the browser
+const authTimeout = 5 * time.Minute
+
+// Port redirected to by the manual authentication, on which nothing need listen
+const redirectPort = 4598
+
+// Returns a random value for the state parameter, which guards against CSRF
+func randomState() (string, error) {
+	randLim := big.NewInt(1)
+	randLim.Lsh(randLim, 200)
+	val, err := rand.Int(rand.Reader, randLim)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(val), nil
 }
 
-func handleOAuthRedirect(port int, wg *sync.WaitGroup, ans *chan map[string]string) {
+// Returns a PKCE code verifier and its S256 code challenge
+func pkcePair() (verifier, challenge string, err error) {
+	buf := make([]byte, 32)
+	if _, err = rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge = base64.RawURLEncoding.EncodeToString(sum[:])
+	return verifier, challenge, nil
+}
+
+// Outcome of the redirect after authentication
+type redirectResult struct {
+	code string
+	err  error
+}
+
+// Serves the redirect after authentication on listener, and sends its outcome on the
+// returned channel. Requests without the expected state are rejected and not sent,
+// since they cannot have come from this authentication.
+func serveOAuthRedirect(listener net.Listener, state string) (<-chan redirectResult, *http.Server) {
 	successBytes := []byte(successResponse)
 	failureBytes := []byte(failureResponse)
+	results := make(chan redirectResult, 1)
+	var once sync.Once
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		queries := r.URL.Query()
-		resp := make(map[string]string)
+		if queries.Get("state") != state {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(failureBytes)
+			return
+		}
 
-		if code, ok := queries["code"]; ok {
-			resp["code"] = code[0]
-			_, err := w.Write(successBytes)
-			if err != nil {
-				log.Fatalf("Failed to write to localhost:%d: %s\n", port, err)
-			}
-		} else if err, ok := queries["error"]; ok {
-			resp["error"] = err[0]
-			_, err := w.Write(failureBytes)
-			if err != nil {
-				log.Fatalf("Failed to write to localhost:%d: %s\n", port, err)
-			}
+		var result redirectResult
+		if code := queries.Get("code"); code != "" {
+			result.code = code
+			w.Write(successBytes)
+		} else if reason := queries.Get("error"); reason != "" {
+			result.err = errors.New(reason)
+			w.Write(failureBytes)
 		} else {
-			_, err := w.Write([]byte("Unknown problem occured"))
-			if err != nil {
-				log.Fatalf("Failed to write to localhost:%d: %s\n", port, err)
-			}
+			result.err = errors.New("something unexpected happened while authenticating")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Unknown problem occured"))
 		}
-
-		*ans <- resp
+		once.Do(func() {
+			results <- result
+		})
 	})
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
-}
 
-func tokenFromFile(file string) (*oauth2.Token, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, err
+	server := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
 	}
-	defer func() {
-		cerr := f.Close()
-		if err == nil {
-			err = cerr
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Failed to serve the redirect: %s\n", err)
 		}
 	}()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(&tok)
-	return tok, err
+	return results, server
 }
 
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
+// Saves token to the token file given by auth, exiting if it cannot be accessed
+func saveToken(auth config.AuthConfig, token *oauth2.Token) {
+	store := mustTokenStore(auth)
+	fmt.Printf("Saving credential file to: %s\n", store.path)
+	if err := store.save(token); err != nil {
 		log.Printf("Unable to cache oauth token: %v", err)
 	}
-	defer f.Close()
-	json.NewEncoder(f).Encode(token)
 }
 
+// ErrChecksumMismatch is returned when the checksum reported by Drive
+// for an upload does not match that of the data which was sent
+var ErrChecksumMismatch = errors.New("checksum reported by Drive does not match the uploaded data")
+
+// ErrFileIO is returned when the local file to be uploaded cannot be read,
+// in which case retrying is pointless
+var ErrFileIO = errors.New("failed in file IO")
+
 // PathID contains the path and the id returned for it
 type PathID struct {
 	path string
@@ -241,13 +283,13 @@ type PathID struct {
 // CreateFile creates the file in drive, with the parent directory specified by
 // parentID and filename same as input file.
 // It does NOT check for the validity of parentID.
-// If queue is nil, the Do() will be executed in this method itself
-func CreateFile(service *drive.Service, local string, parentID string) (string, error) {
+// The checksum computed by algo is stored along with the file, unless Drive computes it by itself.
+// If Drive did not receive the file intact, the upload is deleted and ErrChecksumMismatch is returned.
+func CreateFile(service *drive.Service, local string, parentID string, algo afs.HashAlgorithm) (string, error) {
 	filename := path.Base(local)
 	localfile, err := os.Open(local)
 	if err != nil {
-		log.Println(err)
-		return "", fmt.Errorf("Failed in file IO")
+		return "", fmt.Errorf("%w: %s", ErrFileIO, err)
 	}
 	defer func() {
 		cerr := localfile.Close()
@@ -259,13 +301,10 @@ func CreateFile(service *drive.Service, local string, parentID string) (string,
 	buf := new(bytes.Buffer)
 	_, err = buf.ReadFrom(localfile)
 	if err != nil {
-		log.Println(err)
-		return "", fmt.Errorf("failed in file IO")
+		return "", fmt.Errorf("%w: %s", ErrFileIO, err)
 	}
 	data := buf.Bytes()
-	checksum := fmt.Sprintf("%x", md5.Sum(data))
-	appData := make(map[string]string)
-	appData["md5sum"] = checksum
+	appData := fileAppProperties(local, data, algo)
 
 	driveFile := &drive.File{
 		Name:          filename,
@@ -274,20 +313,30 @@ func CreateFile(service *drive.Service, local string, parentID string) (string,
 	}
 	driveFile, err = service.Files.
 		Create(driveFile).
+		SupportsAllDrives(true).
+		Fields("id, md5Checksum").
 		Media(buf).
 		Do()
 	if err != nil {
 		return "", err
 	}
+	if driveFile.Md5Checksum != fmt.Sprintf("%x", md5.Sum(data)) {
+		// Don't leave a corrupt copy behind, the upload will be retried
+		if err := DeleteFileOrFolder(service, driveFile.Id); err != nil {
+			log.Printf("Failed to delete corrupt upload of %s: %s\n", local, err)
+		}
+		return "", fmt.Errorf("%s: %w", local, ErrChecksumMismatch)
+	}
 	return driveFile.Id, nil
 }
 
-// UpdateFile updates the file to the new contents
-func UpdateFile(service *drive.Service, local, fileID string) (*drive.File, error) {
+// UpdateFile updates the file to the new contents.
+// The checksum computed by algo is stored along with the file, unless Drive computes it by itself.
+// If Drive did not receive the file intact, ErrChecksumMismatch is returned.
+func UpdateFile(service *drive.Service, local, fileID string, algo afs.HashAlgorithm) (*drive.File, error) {
 	localfile, err := os.Open(local)
 	if err != nil {
-		log.Println(err)
-		return nil, fmt.Errorf("failed in file IO")
+		return nil, fmt.Errorf("%w: %s", ErrFileIO, err)
 	}
 
 	defer localfile.Close()
@@ -295,23 +344,97 @@ func UpdateFile(service *drive.Service, local, fileID string) (*drive.File, erro
 	buf := new(bytes.Buffer)
 	_, err = buf.ReadFrom(localfile)
 	if err != nil {
-		log.Println(err)
-		return nil, fmt.Errorf("failed in file IO")
+		return nil, fmt.Errorf("%w: %s", ErrFileIO, err)
 	}
 	data := buf.Bytes()
-	checksum := fmt.Sprintf("%x", md5.Sum(data))
-	appData := make(map[string]string)
-	appData["md5sum"] = checksum
+	appData := fileAppProperties(local, data, algo)
 
 	driveFile := &drive.File{
 		AppProperties: appData,
 	}
+	// Checksums of other algorithms, or stored by earlier versions, are stale
+	clearMissingProperties(driveFile, append(afs.MetadataPropertyKeys(), afs.ChecksumPropertyKeys()...))
 	driveFile, err = service.Files.
 		Update(fileID, driveFile).
+		SupportsAllDrives(true).
 		Fields("*").
 		Media(buf).
 		Do()
-	return driveFile, err
+	if err != nil {
+		return nil, err
+	}
+	if driveFile.Md5Checksum != fmt.Sprintf("%x", md5.Sum(data)) {
+		return nil, fmt.Errorf("%s: %w", local, ErrChecksumMismatch)
+	}
+	return driveFile, nil
+}
+
+// UpdateMetadata updates the metadata (permissions, modification time, etc)
+// stored along with the file in Drive, without uploading its contents again
+func UpdateMetadata(service *drive.Service, local, fileID string) (*drive.File, error) {
+	meta, err := afs.ReadMetadata(local)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFileIO, err)
+	}
+	driveFile := &drive.File{
+		AppProperties: meta.AppProperties(),
+	}
+	clearMissingProperties(driveFile, append(afs.MetadataPropertyKeys(), afs.LegacyChecksumProperty))
+	return service.Files.
+		Update(fileID, driveFile).
+		SupportsAllDrives(true).
+		Fields("id, appProperties").
+		Do()
+}
+
+// Makes an update of file delete the appProperties with the given keys which it does not set
+// (such as the symlink target of a symlink replaced by a regular file), since Drive
+// merges appProperties on update rather than replacing them. They are sent as null,
+// which is how Drive is told to delete a key.
+func clearMissingProperties(file *drive.File, keys []string) {
+	for _, key := range keys {
+		if _, ok := file.AppProperties[key]; !ok {
+			file.NullFields = append(file.NullFields, "AppProperties."+key)
+		}
+	}
+	if len(file.NullFields) > 0 {
+		file.ForceSendFields = append(file.ForceSendFields, "AppProperties")
+	}
+}
+
+// Returns the appProperties to be stored in Drive for the file at local,
+// whose contents are data
+func fileAppProperties(local string, data []byte, algo afs.HashAlgorithm) map[string]string {
+	appData := make(map[string]string)
+	if meta, err := afs.ReadMetadata(local); err == nil {
+		appData = meta.AppProperties()
+	}
+	if key := algo.AppProperty(); key != "" {
+		sum := algo.New()
+		sum.Write(data)
+		appData[key] = fmt.Sprintf("%x", sum.Sum(nil))
+	}
+	return appData
+}
+
+// DownloadFile downloads the contents of the file in Drive with the given ID to local,
+// which must not exist already.
+func DownloadFile(service *drive.Service, fileID, local string) error {
+	resp, err := service.Files.Get(fileID).SupportsAllDrives(true).Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	localfile, err := os.OpenFile(local, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(localfile, resp.Body); err != nil {
+		localfile.Close()
+		return err
+	}
+	return localfile.Close()
 }
 
 // RenameInfo contains fields necessary for renaming a file/folder
@@ -332,6 +455,7 @@ func RenameFileOrFolder(service *drive.Service, info RenameInfo) (*drive.File, e
 		Update(info.ID, file).
 		RemoveParents(info.OldParentID).
 		AddParents(info.NewParentID).
+		SupportsAllDrives(true).
 		Fields("*").
 		Do()
 	return driveFile, err
@@ -340,73 +464,169 @@ func RenameFileOrFolder(service *drive.Service, info RenameInfo) (*drive.File, e
 // CreateFolder creates a folder in drive, with a parent directory specified by parentID
 // If no parent directories are specified, then it is not set
 func CreateFolder(service *drive.Service, remote string, parentID ...string) (string, error) {
+	return CreateMarkedFolder(service, remote, nil, parentID...)
+}
+
+// CreateDirectoryFolder creates a folder in drive for a local directory like CreateFolder,
+// recording the metadata of the directory (its permissions and modification time) for restore.
+// Unknown metadata, with a zero modification time, is not recorded.
+func CreateDirectoryFolder(service *drive.Service, remote string, meta afs.Metadata, parentID ...string) (string, error) {
+	var props map[string]string
+	if !meta.ModTime.IsZero() {
+		props = meta.AppProperties()
+	}
+	return CreateMarkedFolder(service, remote, props, parentID...)
+}
+
+// CreateMarkedFolder creates a folder in drive like CreateFolder, marked with the given appProperties
+func CreateMarkedFolder(service *drive.Service, remote string, props map[string]string, parentID ...string) (string, error) {
 	parts := afs.SplitPathPlatform(remote)
 	dir := &drive.File{
-		Name:     parts[len(parts)-1],
-		MimeType: "application/vnd.google-apps.folder",
-		Parents:  parentID,
+		Name:          parts[len(parts)-1],
+		MimeType:      folderMimeType,
+		Parents:       parentID,
+		AppProperties: props,
+	}
+	file, err := service.Files.Create(dir).SupportsAllDrives(true).Do()
+	if err != nil {
+		return "", err
 	}
-	file, err := service.Files.Create(dir).Do()
-	return file.Id, err
+	return file.Id, nil
 }
 
 // DeleteFileOrFolder deletes the file (or folder) in the drive with the givwn ID
 func DeleteFileOrFolder(service *drive.Service, id string) error {
-	return service.Files.Delete(id).Do()
+	return service.Files.Delete(id).SupportsAllDrives(true).Do()
 }
 
-// QueryFileID queries Google drive for the id of a file (or folder) with the givwn path
-// If the file is found, then err is nil
-func QueryFileID(service *drive.Service, local string) (string, error) {
-	parts := afs.SplitPathPlatform(local)
-	name := parts[len(parts)-1]
+// ErrNotFound is returned when a file is not found in Drive
+var ErrNotFound = errors.New("not found in Drive")
 
-	nextPageToken := ""
+// Files with this MIME type are folders
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// Fields of files retrieved by queries, which are all that is needed to reconstruct trees
+const fileFields = "files(name, id, parents, mimeType, md5Checksum, appProperties)"
+
+// Parents which are queried for together by QueryDescendants, to keep the query short
+const maxParentsPerQuery = 50
+
+// QueryFileID queries Google drive for the id of the file (or folder) with the given name
+// in the folder with ID parentID, or at the top of the drive if parentID is empty.
+// If the file is not found, the error is ErrNotFound.
+// The shared drive with the given ID is queried, or My Drive if driveID is empty.
+func QueryFileID(service *drive.Service, driveID, parentID, name string) (string, error) {
+	if parentID == "" {
+		parentID = topFolderID(driveID)
+	}
+	q := fmt.Sprintf("name = %s and %s in parents", quoteQuery(name), quoteQuery(parentID))
+	files, err := QueryFiles(service, driveID, q)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return files[0].Id, nil
+}
 
+// QueryFiles returns all the files matching the query q which were not trashed by the user,
+// following every page of the results. All files are returned if q is empty.
+// See https://developers.google.com/drive/api/v3/search-files for the syntax of q.
+// The shared drive with the given ID is queried, or My Drive if driveID is empty.
+func QueryFiles(service *drive.Service, driveID, q string) ([]*drive.File, error) {
+	if q == "" {
+		q = "trashed = false"
+	} else {
+		q = fmt.Sprintf("(%s) and trashed = false", q)
+	}
+	var files []*drive.File
+	nextPageToken := ""
 	for {
-		listCall := service.Files.List().
-			Fields("nextPageToken, files(name, id, trashed)")
+		listCall := listFiles(service, driveID).
+			Q(q).
+			PageSize(1000).
+			Fields("nextPageToken, " + fileFields)
 		if nextPageToken != "" {
 			listCall = listCall.PageToken(nextPageToken)
 		}
 		list, err := listCall.Do()
 		if err != nil {
-			return "", err
-		}
-		for _, file := range list.Files {
-			if !file.Trashed && file.Name == name {
-				return file.Id, nil
-			}
+			return nil, err
 		}
+		files = append(files, list.Files...)
+		nextPageToken = list.NextPageToken
 		if nextPageToken == "" {
 			break
 		}
 	}
-	return "", fmt.Errorf("didn't find %s in you Drive", local)
+	return files, nil
 }
 
-// QueryAllContents returns a list of all the files uploaded to Drive by
-// Piledriver that were not trashed by the user
-func QueryAllContents(service *drive.Service) ([]*drive.File, error) {
-	nextPageToken := ""
-	var nonTrashFiles []*drive.File
+// QueryDescendants returns all the files below the folder with the given ID
+// which were not trashed by the user. The folders at each depth are queried together.
+// The shared drive with the given ID is queried, or My Drive if driveID is empty.
+func QueryDescendants(service *drive.Service, driveID, folderID string) ([]*drive.File, error) {
+	var descendants []*drive.File
+	parents := []string{folderID}
+	for len(parents) > 0 {
+		batch := parents
+		if len(batch) > maxParentsPerQuery {
+			batch = batch[:maxParentsPerQuery]
+		}
+		parents = parents[len(batch):]
 
-	for {
-		listCall := service.Files.List().
-			Fields("nextPageToken, files(name, id, trashed, parents, mimeType, appProperties)").
-			PageToken(nextPageToken)
-		list, err := listCall.Do()
+		clauses := make([]string, len(batch))
+		for i, id := range batch {
+			clauses[i] = fmt.Sprintf("%s in parents", quoteQuery(id))
+		}
+		files, err := QueryFiles(service, driveID, strings.Join(clauses, " or "))
 		if err != nil {
 			return nil, err
 		}
-		for _, file := range list.Files {
-			if !file.Trashed {
-				nonTrashFiles = append(nonTrashFiles, file)
+		for _, file := range files {
+			descendants = append(descendants, file)
+			if file.MimeType == folderMimeType {
+				parents = append(parents, file.Id)
 			}
 		}
-		if nextPageToken == "" {
-			break
-		}
 	}
-	return nonTrashFiles, nil
+	return descendants, nil
+}
+
+// QueryAllContents returns a list of all the files uploaded to Drive by
+// Piledriver that were not trashed by the user
+// The shared drive with the given ID is queried, or My Drive if driveID is empty.
+func QueryAllContents(service *drive.Service, driveID string) ([]*drive.File, error) {
+	return QueryFiles(service, driveID, "")
+}
+
+// Returns value as a string literal in a query
+func quoteQuery(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "'", `\'`)
+	return "'" + value + "'"
+}
+
+// Returns the ID of the top folder of the shared drive with the given ID,
+// or of My Drive if driveID is empty
+func topFolderID(driveID string) string {
+	if driveID != "" {
+		return driveID
+	}
+	return "root"
+}
+
+// Returns a call which lists the files in the shared drive with the given ID,
+// or in My Drive if driveID is empty
+func listFiles(service *drive.Service, driveID string) *drive.FilesListCall {
+	listCall := service.Files.List()
+	if driveID != "" {
+		listCall = listCall.
+			Corpora("drive").
+			DriveId(driveID).
+			IncludeItemsFromAllDrives(true).
+			SupportsAllDrives(true)
+	}
+	return listCall
 }
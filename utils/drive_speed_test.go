@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/RedDocMD/piledriver/afs"
+	"github.com/RedDocMD/piledriver/config"
 	"google.golang.org/api/drive/v3"
 )
 
@@ -16,7 +17,7 @@ func createTestFile() {
 	if err != nil {
 		log.Fatalln(err)
 	}
-	_, err = CreateFile(service, "test_data/speed", id)
+	_, err = CreateFile(service, "test_data/speed", id, afs.MD5)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -30,7 +31,7 @@ func createService() {
 	homedirParts := afs.SplitPathPlatform(homedir)
 	tokenPathParts := append(homedirParts, []string{".config", ".piledriver.token"}...)
 	tokenPath := afs.JoinPathPlatform(tokenPathParts, true)
-	service = GetDriveService(tokenPath)
+	service = GetDriveService(config.AuthConfig{TokenPath: tokenPath})
 }
 
 func BenchmarkListSpeed(b *testing.B) {
@@ -39,7 +40,7 @@ func BenchmarkListSpeed(b *testing.B) {
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
-		_, err := QueryFileID(service, "piledriver/speed")
+		_, err := ResolvePath(service, "", "", "piledriver/speed")
 		if err != nil {
 			b.Error(err)
 		}
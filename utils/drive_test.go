@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/alecthomas/assert"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestClearMissingMetadata(t *testing.T) {
+	assert := assert.New(t)
+	file := &drive.File{AppProperties: map[string]string{"size": "3", "mtime": "1", "mode": "644"}}
+	clearMissingProperties(file, afs.MetadataPropertyKeys())
+	data, err := json.Marshal(file)
+	assert.NoError(err)
+	assert.Equal(`{"appProperties":{"mode":"644","mtime":"1","size":"3","symlink":null}}`, string(data))
+
+	file = &drive.File{AppProperties: map[string]string{"size": "3", "mtime": "1", "mode": "644", "symlink": "target"}}
+	clearMissingProperties(file, afs.MetadataPropertyKeys())
+	assert.Equal(0, len(file.NullFields))
+}
+
+func TestUpdateDeletesLegacyChecksum(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver-drive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "file")
+	assert.NoError(ioutil.WriteFile(local, []byte("contents"), 0644))
+
+	// Uploaded by an earlier version, and then with SHA-256
+	file := &drive.File{Id: "file", Name: "file", Parents: []string{"root"}, AppProperties: map[string]string{
+		afs.LegacyChecksumProperty: "stale",
+		afs.SHA256.AppProperty():   "stale",
+	}}
+	requests := 0
+	service := fakeDrive(t, []*drive.File{file}, &requests)
+
+	_, err = UpdateFile(service, local, file.Id, afs.MD5)
+	assert.NoError(err)
+	_, ok := file.AppProperties[afs.LegacyChecksumProperty]
+	assert.False(ok)
+	_, ok = file.AppProperties[afs.SHA256.AppProperty()]
+	assert.False(ok)
+	assert.Equal("8", file.AppProperties["size"])
+
+	// The checksum is kept when only the metadata is updated
+	file.AppProperties[afs.LegacyChecksumProperty] = "stale"
+	file.AppProperties[afs.SHA256.AppProperty()] = "current"
+	_, err = UpdateMetadata(service, local, file.Id)
+	assert.NoError(err)
+	_, ok = file.AppProperties[afs.LegacyChecksumProperty]
+	assert.False(ok)
+	assert.Equal("current", file.AppProperties[afs.SHA256.AppProperty()])
+}
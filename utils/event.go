@@ -1,11 +1,15 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/RedDocMD/piledriver/afs"
+	"google.golang.org/api/googleapi"
 )
 
 // EventCategory denotes the type of event that has been detected
@@ -20,9 +24,33 @@ const (
 	FileRenamed
 	DirectoryRenamed
 	FileWritten
+	MetadataChanged
 	MaxEventCategory
 )
 
+// Names of the event categories, as used in the config
+var categoryNames = [MaxEventCategory]string{
+	FileCreated:      "fileCreated",
+	DirectoryCreated: "directoryCreated",
+	FileDeleted:      "fileDeleted",
+	DirectoryDeleted: "directoryDeleted",
+	FileRenamed:      "fileRenamed",
+	DirectoryRenamed: "directoryRenamed",
+	FileWritten:      "fileWritten",
+	MetadataChanged:  "metadataChanged",
+}
+
+// ParseEventCategory returns the event category with the given name (eg, fileWritten).
+// Names are case-insensitive.
+func ParseEventCategory(name string) (EventCategory, error) {
+	for cat, catName := range categoryNames {
+		if strings.EqualFold(name, catName) {
+			return EventCategory(cat), nil
+		}
+	}
+	return MaxEventCategory, fmt.Errorf("unknown event category: %s", name)
+}
+
 // IDKey denotes the key for the ID type
 type IDKey int
 
@@ -34,11 +62,12 @@ const (
 
 // Event is the internal representation of file watcher events
 type Event struct {
-	OldPath   string
-	Path      string
-	Category  EventCategory
-	IDMap     map[IDKey]string
-	Timestamp time.Time
+	OldPath    string
+	Path       string
+	Category   EventCategory
+	IDMap      map[IDKey]string
+	Timestamp  time.Time
+	Generation uint64 // Generation of the tree of Path when the event was pushed (see State.Rescan)
 }
 
 func (ev Event) String() string {
@@ -58,6 +87,8 @@ func (ev Event) String() string {
 		catString = "DIRECTORY RENAMED"
 	case FileWritten:
 		catString = "FILE WRITTEN"
+	case MetadataChanged:
+		catString = "METADATA CHANGED"
 	default:
 		catString = "Unknown event type"
 	}
@@ -68,8 +99,17 @@ func (ev Event) String() string {
 	return fmt.Sprintf("%s   %s", catString, ev.Path)
 }
 
-// ExecuteEvents takes a channel Events and executes them
+// ExecuteEvents takes a channel Events and executes them.
+// No events are executed while they are paused by PauseEvents.
 func ExecuteEvents(state *State) {
+	for ev := range state.DebouncedEvents {
+		state.eventsMu.Lock()
+		executeEvent(state, ev)
+		state.eventsMu.Unlock()
+	}
+}
+
+func executeEvent(state *State, ev Event) {
 	var getID, getParentID func(path string) (string, bool)
 	var pathName func(path string) string
 
@@ -86,129 +126,199 @@ func ExecuteEvents(state *State) {
 		return parts[len(parts)-1]
 	}
 
-	const sleepTime = 5 * time.Second
-
-	for ev := range state.DebouncedEvents {
-		log.Println(ev)
-		switch ev.Category {
-		case FileCreated:
-			path := ev.Path
-			parentID, ok := getParentID(path)
-			if !ok {
-				log.Printf("Node for parent of %s not found\n", path)
-				continue
-			}
-			var fileID string
-			var err error
-			for {
-				fileID, err = CreateFile(state.service, path, parentID)
-				if err != nil && err.Error() != "Failed in file IO" {
-					log.Println(err)
-					time.Sleep(sleepTime)
-				} else {
-					if err != nil {
-						log.Printf("Failed to read from %s\n", path)
-					}
-					break
-				}
-			}
-			ok = state.attachID(path, fileID)
-			if !ok {
-				log.Printf("Failed to attach id of %s\n", path)
-			}
-		case DirectoryCreated:
-			path := ev.Path
-			parentID, ok := getParentID(path)
-			if !ok {
-				log.Printf("Node for parent of %s not found\n", path)
-				continue
-			}
-			var fileID string
-			var err error
-			for {
-				fileID, err = CreateFolder(state.service, path, parentID)
-				if err != nil {
-					log.Println(err)
-					time.Sleep(sleepTime)
-				} else {
-					break
-				}
-			}
-			ok = state.attachID(path, fileID)
-			if !ok {
-				log.Printf("Failed to attach id of %s\n", path)
-			}
-		case FileDeleted:
-			fallthrough
-		case DirectoryDeleted:
-			id := ev.IDMap[CurrID]
-			for {
-				err := DeleteFileOrFolder(state.service, id)
-				if err != nil {
-					log.Println(err)
-					time.Sleep(sleepTime)
-				} else {
-					break
-				}
-			}
-		case FileRenamed:
-			fallthrough
-		case DirectoryRenamed:
-			oldPath := ev.OldPath
-			newPath := ev.Path
-
-			id, ok := getID(newPath)
-			if !ok {
-				log.Printf("Failed to retrieve ID of %s\n", newPath)
-				continue
-			}
-			oldParentID, ok := getParentID(oldPath)
-			if !ok {
-				log.Printf("Failed to retrieve ID of parent of %s\n", oldPath)
-				continue
+	if ev.Generation != state.generation(ev.Path) {
+		log.Printf("Dropping %s, made redundant by a rescan\n", ev)
+		return
+	}
+	log.Println(ev)
+	remote, ok := state.Remote(ev.Path)
+	if !ok {
+		log.Printf("No remote found for %s\n", ev.Path)
+		return
+	}
+	service := remote.Service
+	if ev.Category == FileCreated || ev.Category == DirectoryCreated {
+		if id, ok := getID(ev.Path); ok && id != "" {
+			// Already created in Drive by a rescan, which may have missed later writes
+			if ev.Category == DirectoryCreated {
+				return
 			}
-			newParentID, ok := getParentID(newPath)
-			if !ok {
-				log.Printf("Failed to retrieve ID of parent of %s\n", newPath)
-				continue
+			ev.Category = FileWritten
+		}
+	}
+	switch ev.Category {
+	case FileCreated:
+		path := ev.Path
+		parentID, ok := getParentID(path)
+		if !ok {
+			log.Printf("Node for parent of %s not found\n", path)
+			return
+		}
+		var fileID string
+		err := withRetries(func() (err error) {
+			fileID, err = CreateFile(service, path, parentID, state.algo)
+			return err
+		})
+		if errors.Is(err, ErrFileIO) {
+			log.Printf("Failed to read from %s: %s\n", path, err)
+			return
+		} else if err != nil {
+			giveUp(state, ev, err)
+			return
+		}
+		ok = state.attachID(path, fileID)
+		if !ok {
+			// Removed (or saved over another file) while being uploaded
+			log.Printf("Failed to attach id of %s, deleting it from Drive\n", path)
+			if err := DeleteFileOrFolder(service, fileID); err != nil {
+				log.Println(err)
 			}
+		}
+	case DirectoryCreated:
+		path := ev.Path
+		parentID, ok := getParentID(path)
+		if !ok {
+			log.Printf("Node for parent of %s not found\n", path)
+			return
+		}
+		meta, _ := state.metadata(path)
+		var fileID string
+		err := withRetries(func() (err error) {
+			fileID, err = CreateDirectoryFolder(service, path, meta, parentID)
+			return err
+		})
+		if err != nil {
+			giveUp(state, ev, err)
+			return
+		}
+		ok = state.attachID(path, fileID)
+		if !ok {
+			log.Printf("Failed to attach id of %s\n", path)
+		}
+	case FileDeleted:
+		fallthrough
+	case DirectoryDeleted:
+		id := ev.IDMap[CurrID]
+		if id == "" {
+			// Never made it to Drive
+			return
+		}
+		err := withRetries(func() error {
+			return DeleteFileOrFolder(service, id)
+		})
+		if err != nil && !isNotFound(err) {
+			// Not found means it is already gone (eg, deleted by a rescan)
+			giveUp(state, ev, err)
+		}
+	case FileRenamed:
+		fallthrough
+	case DirectoryRenamed:
+		oldPath := ev.OldPath
+		newPath := ev.Path
 
-			info := RenameInfo{
-				ID:          id,
-				NewParentID: newParentID,
-				OldParentID: oldParentID,
-				NewName:     pathName(newPath),
-			}
+		id, ok := getID(newPath)
+		if !ok {
+			log.Printf("Failed to retrieve ID of %s\n", newPath)
+			return
+		}
+		oldParentID, ok := getParentID(oldPath)
+		if !ok {
+			log.Printf("Failed to retrieve ID of parent of %s\n", oldPath)
+			return
+		}
+		newParentID, ok := getParentID(newPath)
+		if !ok {
+			log.Printf("Failed to retrieve ID of parent of %s\n", newPath)
+			return
+		}
 
-			for {
-				_, err := RenameFileOrFolder(state.service, info)
-				if err != nil {
-					log.Println(err)
-					time.Sleep(sleepTime)
-				} else {
-					break
-				}
-			}
-		case FileWritten:
-			path := ev.Path
-			id, ok := getID(path)
-			if !ok {
-				log.Printf("Failed to retrieve ID of %s\n", path)
-				continue
-			}
-			for {
-				_, err := UpdateFile(state.service, path, id)
-				if err != nil && err.Error() != "Failed in file IO" {
-					log.Println(err)
-					time.Sleep(sleepTime)
-				} else {
-					if err != nil {
-						log.Printf("Failed to read from %s\n", path)
-					}
-					break
-				}
+		info := RenameInfo{
+			ID:          id,
+			NewParentID: newParentID,
+			OldParentID: oldParentID,
+			NewName:     pathName(newPath),
+		}
 
-			}
+		err := withRetries(func() error {
+			_, err := RenameFileOrFolder(service, info)
+			return err
+		})
+		if err != nil {
+			giveUp(state, ev, err)
+		}
+	case FileWritten:
+		path := ev.Path
+		id, ok := getID(path)
+		if !ok {
+			log.Printf("Failed to retrieve ID of %s\n", path)
+			return
+		}
+		if id == "" {
+			// Yet to be uploaded, which will pick up the latest contents anyway
+			return
+		}
+		err := withRetries(func() error {
+			_, err := UpdateFile(service, path, id, state.algo)
+			return err
+		})
+		if errors.Is(err, ErrFileIO) {
+			log.Printf("Failed to read from %s: %s\n", path, err)
+		} else if err != nil {
+			giveUp(state, ev, err)
+		}
+	case MetadataChanged:
+		path := ev.Path
+		id, ok := getID(path)
+		if !ok {
+			log.Printf("Failed to retrieve ID of %s\n", path)
+			return
+		}
+		if id == "" {
+			// Yet to be uploaded, which will pick up the latest metadata anyway
+			return
+		}
+		err := withRetries(func() error {
+			_, err := UpdateMetadata(service, path, id)
+			return err
+		})
+		if errors.Is(err, ErrFileIO) {
+			log.Printf("Failed to read metadata of %s: %s\n", path, err)
+		} else if err != nil {
+			giveUp(state, ev, err)
+		}
+	}
+}
+
+// Delay before the first retry of a failed Drive request, which doubles with each attempt
+var retryDelay = 5 * time.Second
+
+// Number of times a Drive request is attempted before the event is given up on
+const maxAttempts = 5
+
+// Calls request until it succeeds or has been attempted maxAttempts times, and returns its last error.
+// Errors which will not go away by retrying (unreadable files, and files not found in Drive) are returned at once.
+func withRetries(request func() error) error {
+	delay := retryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = request()
+		if err == nil || errors.Is(err, ErrFileIO) || isNotFound(err) || attempt == maxAttempts {
+			return err
 		}
+		log.Println(err)
+		time.Sleep(delay)
+		delay *= 2
 	}
 }
+
+// Logs that ev could not be executed, and requests a rescan of its tree to bring Drive back in sync
+func giveUp(state *State, ev Event, err error) {
+	log.Printf("Giving up on %s: %s\n", ev, err)
+	state.RequestRescan(ev.Path)
+}
+
+// Returns whether err is a Drive API error for a file which does not exist
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/alecthomas/assert"
+	"github.com/fsnotify/fsnotify"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRescanMakesEventsStale(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "piledriver-event")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	state := NewState()
+	state.InitWatcher()
+	defer state.watcher.Close()
+	assert.NoError(state.AddDir(root))
+
+	file := filepath.Join(root, "file")
+	assert.NoError(ioutil.WriteFile(file, nil, 0644))
+	handleWatchEvent(state, &renameTracker{}, fsnotify.Event{Name: file, Op: fsnotify.Create})
+	before := <-state.FileEvents
+	assert.Equal(state.generation(file), before.Generation)
+
+	assert.NoError(state.Rescan(root, func(*afs.Tree) error { return nil }))
+	assert.NoError(ioutil.WriteFile(file, []byte("contents"), 0644))
+	handleWatchEvent(state, &renameTracker{}, fsnotify.Event{Name: file, Op: fsnotify.Write})
+	after := <-state.FileEvents
+	assert.NotEqual(state.generation(file), before.Generation)
+	assert.Equal(state.generation(file), after.Generation)
+}
+
+func TestFailedRescanKeepsEvents(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "piledriver-event")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	state := NewState()
+	state.InitWatcher()
+	defer state.watcher.Close()
+	assert.NoError(state.AddDir(root))
+	old, _ := state.Tree(root)
+	generation := state.generation(root)
+
+	err = state.Rescan(root, func(*afs.Tree) error { return errors.New("unavailable") })
+	assert.Error(err)
+	tree, _ := state.Tree(root)
+	assert.True(tree == old)
+	assert.Equal(generation, state.generation(root))
+}
+
+// Run with -race: the watchers must not change the tree being reconciled
+func TestRescanWhileCreatingFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "piledriver-event")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	state := NewState()
+	state.InitWatcher()
+	defer state.watcher.Close()
+	assert.NoError(t, state.AddDir(root))
+	go WatchLoop(state)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-state.FileEvents:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	created := make(chan struct{})
+	go func() {
+		defer close(created)
+		for i := 0; i < 100; i++ {
+			dir := filepath.Join(root, fmt.Sprintf("dir%d", i))
+			os.Mkdir(dir, 0755)
+			ioutil.WriteFile(filepath.Join(dir, "file"), []byte("contents"), 0644)
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		err := state.Rescan(root, func(tree *afs.Tree) error {
+			tree.Walk(root, func(string, *afs.Node) {})
+			return tree.CalculateChecksums(nil, false)
+		})
+		assert.NoError(t, err)
+	}
+	<-created
+}
+
+func TestWithRetries(t *testing.T) {
+	assert := assert.New(t)
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Millisecond
+
+	attempts := 0
+	err := withRetries(func() error {
+		attempts++
+		return errors.New("unavailable")
+	})
+	assert.Error(err)
+	assert.Equal(maxAttempts, attempts)
+
+	attempts = 0
+	err = withRetries(func() error {
+		attempts++
+		return &googleapi.Error{Code: http.StatusNotFound}
+	})
+	assert.True(isNotFound(err))
+	assert.Equal(1, attempts)
+
+	attempts = 0
+	err = withRetries(func() error {
+		attempts++
+		return fmt.Errorf("%w: permission denied", ErrFileIO)
+	})
+	assert.True(errors.Is(err, ErrFileIO))
+	assert.Equal(1, attempts)
+
+	attempts = 0
+	err = withRetries(func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("unavailable")
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(3, attempts)
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"google.golang.org/api/drive/v3"
+)
+
+// Keys under which the folders backed up to are marked in their appProperties,
+// so that they are found regardless of their names
+const (
+	roleProperty    = "role"
+	machineProperty = "machine"
+	pathProperty    = "path"
+)
+
+// Roles of the marked folders
+const (
+	machineRole   = "machine"   // Holds the directories backed up from a machine
+	directoryRole = "directory" // A directory is backed up to it
+)
+
+// MachineProperties returns the appProperties which mark the folder holding the directories
+// backed up from the machine with the given identifier
+func MachineProperties(machineID string) map[string]string {
+	return map[string]string{
+		roleProperty:    machineRole,
+		machineProperty: propertyValue(machineProperty, machineID),
+	}
+}
+
+// DirectoryProperties returns the appProperties which mark the folder that the directory
+// at local is backed up to, from the machine with the given identifier
+func DirectoryProperties(machineID, local string) map[string]string {
+	return map[string]string{
+		roleProperty:    directoryRole,
+		machineProperty: propertyValue(machineProperty, machineID),
+		pathProperty:    propertyValue(pathProperty, filepath.Clean(local)),
+	}
+}
+
+// Returns value, or its hash if it is too long to be stored under key
+func propertyValue(key, value string) string {
+	if len(key)+len(value) <= afs.MaxPropertySize {
+		return value
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(value)))
+}
+
+// FindMarkedFolder returns the ID of the folder marked with props, in the folder with ID parentID,
+// or anywhere in the drive if parentID is empty. If it is not found, the error is ErrNotFound.
+// The shared drive with the given ID is queried, or My Drive if driveID is empty.
+func FindMarkedFolder(service *drive.Service, driveID, parentID string, props map[string]string) (string, error) {
+	q := markerQuery(props)
+	if parentID != "" {
+		q = fmt.Sprintf("%s and %s in parents", q, quoteQuery(parentID))
+	}
+	files, err := QueryFiles(service, driveID, q)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("folder marked as %s: %w", props[roleProperty], ErrNotFound)
+	}
+	return files[0].Id, nil
+}
+
+// AdoptFolder returns the ID of the folder marked with props, like FindMarkedFolder.
+// Failing that, an unmarked folder with the given name in the folder with ID parentID
+// (or at the top of the drive if parentID is empty), as created by earlier versions, is marked and returned.
+// If neither is found, the error is ErrNotFound.
+func AdoptFolder(service *drive.Service, driveID, parentID, name string, props map[string]string) (string, error) {
+	id, err := FindMarkedFolder(service, driveID, parentID, props)
+	if !errors.Is(err, ErrNotFound) {
+		return id, err
+	}
+
+	folderParentID := parentID
+	if folderParentID == "" {
+		folderParentID = topFolderID(driveID)
+	}
+	q := fmt.Sprintf("name = %s and %s in parents and mimeType = %s",
+		quoteQuery(name), quoteQuery(folderParentID), quoteQuery(folderMimeType))
+	files, err := QueryFiles(service, driveID, q)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if _, marked := file.AppProperties[roleProperty]; marked {
+			// Belongs to another machine or directory
+			continue
+		}
+		_, err := service.Files.
+			Update(file.Id, &drive.File{AppProperties: props}).
+			SupportsAllDrives(true).
+			Fields("id").
+			Do()
+		if err != nil {
+			return "", err
+		}
+		return file.Id, nil
+	}
+	return "", fmt.Errorf("%s: %w", name, ErrNotFound)
+}
+
+// Returns a query for the files marked with props
+func markerQuery(props map[string]string) string {
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	clauses := make([]string, len(keys))
+	for i, key := range keys {
+		clauses[i] = fmt.Sprintf("appProperties has { key=%s and value=%s }", quoteQuery(key), quoteQuery(props[key]))
+	}
+	return strings.Join(clauses, " and ")
+}
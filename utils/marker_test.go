@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestDirectoryProperties(t *testing.T) {
+	assert := assert.New(t)
+	props := DirectoryProperties("x", "/home/deep/work/")
+	assert.Equal(map[string]string{"role": "directory", "machine": "x", "path": "/home/deep/work"}, props)
+
+	long := "/" + strings.Repeat("a", 200)
+	props = DirectoryProperties("x", long)
+	assert.True(strings.HasPrefix(props[pathProperty], "sha256:"))
+	assert.Equal(props, DirectoryProperties("x", long))
+	assert.NotEqual(props, DirectoryProperties("x", long+"b"))
+}
+
+func TestAdoptFolder(t *testing.T) {
+	assert := assert.New(t)
+	files := []*drive.File{
+		{Id: "other-machine", Name: "piledriver-x", Parents: []string{"root"}, MimeType: folderMimeType,
+			AppProperties: MachineProperties("y")},
+		{Id: "legacy", Name: "piledriver-x", Parents: []string{"root"}, MimeType: folderMimeType},
+		{Id: "moved", Name: "AOC (old)", Parents: []string{"legacy"}, MimeType: folderMimeType,
+			AppProperties: DirectoryProperties("x", "/home/deep/aoc")},
+	}
+	requests := 0
+	service := fakeDrive(t, files, &requests)
+
+	// The folder of another machine with the same name is skipped, and the unmarked one adopted
+	id, err := AdoptFolder(service, "", "", "piledriver-x", MachineProperties("x"))
+	assert.NoError(err)
+	assert.Equal("legacy", id)
+	assert.Equal(MachineProperties("x"), files[1].AppProperties)
+	id, err = FindMarkedFolder(service, "", "", MachineProperties("x"))
+	assert.NoError(err)
+	assert.Equal("legacy", id)
+
+	// Marked folders are found regardless of their names
+	id, err = AdoptFolder(service, "", "legacy", "AOC", DirectoryProperties("x", "/home/deep/aoc"))
+	assert.NoError(err)
+	assert.Equal("moved", id)
+
+	_, err = AdoptFolder(service, "", "legacy", "config", DirectoryProperties("x", "/home/deep/.config"))
+	assert.True(errors.Is(err, ErrNotFound))
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/RedDocMD/piledriver/afs"
+)
+
+// DefaultPollInterval is the interval at which directories are polled, unless configured otherwise
+const DefaultPollInterval = 30 * time.Second
+
+// PollLoop polls the directories added by AddPolledDir (or which could not be watched)
+// for changes, each at its own interval, and pushes the same events that WatchLoop does
+// for the changes it finds
+func PollLoop(state *State) {
+	next := make(map[string]time.Time) // Map from path to time of next poll
+	for {
+		now := time.Now()
+		wake := now.Add(DefaultPollInterval)
+		for dir, interval := range state.polledDirs() {
+			due, ok := next[dir]
+			if !ok {
+				due = now.Add(interval)
+			} else if !now.Before(due) {
+				pollDir(state, dir)
+				due = time.Now().Add(interval)
+			}
+			next[dir] = due
+			if due.Before(wake) {
+				wake = due
+			}
+		}
+		time.Sleep(time.Until(wake))
+	}
+}
+
+// The state of a path, as seen on disk or in the tree
+type pathEntry struct {
+	isDir bool
+	meta  afs.Metadata
+}
+
+// Compares dir in the tree with the disk, and pushes events for the differences
+func pollDir(state *State, dir string) {
+	timestamp := time.Now()
+	if !state.pathExists(dir) {
+		// Deleted or moved away, as seen by the poll of a parent or the watch on it
+		state.stopPolling(dir)
+		return
+	}
+	disk, unreadable, err := scanEntries(dir)
+	if err != nil {
+		// Better to skip a poll than to delete everything when a mount goes away
+		log.Printf("Failed to poll %s: %s\n", dir, err)
+		return
+	}
+	tree := state.treeEntries(dir)
+	// For the same reason, whatever could not be read is left as it is in the tree
+	for path, entry := range tree {
+		for _, unreadablePath := range unreadable {
+			if afs.IsSubPath(path, unreadablePath) {
+				disk[path] = entry
+			}
+		}
+	}
+
+	// A path which has disappeared and a path which has appeared may be a rename
+	removed, added, _ := compareEntries(tree, disk)
+	candidates := topLevel(removed)
+	renamed := false
+	for _, path := range topLevel(added) {
+		entry := disk[path]
+		for i, oldPath := range candidates {
+			if isRename(tree[oldPath], entry) {
+				renamePath(state, oldPath, path, entry.isDir, timestamp)
+				candidates = append(candidates[:i], candidates[i+1:]...)
+				renamed = true
+				break
+			}
+		}
+	}
+	if renamed {
+		tree = state.treeEntries(dir)
+	}
+
+	removed, added, written := compareEntries(tree, disk)
+	for _, path := range topLevel(removed) {
+		removePath(state, path, tree[path].isDir, timestamp)
+	}
+	for _, path := range added {
+		isDir := disk[path].isDir
+		if ok := state.addPath(path, isDir); !ok {
+			log.Println("Failed to add", path, "to tree")
+		}
+		state.refreshMetadata(path)
+		category := FileCreated
+		if isDir {
+			category = DirectoryCreated
+		}
+		pushCreate(state, path, category, timestamp)
+	}
+	for _, path := range written {
+		pushWrite(state, path, timestamp)
+	}
+}
+
+// Returns whether the entry which has disappeared may have been renamed to the one which has appeared.
+// Inodes are reused, so unlike in WatchLoop, a file must also be unchanged to be paired.
+// Without inodes, directories are never paired.
+func isRename(oldEntry, newEntry pathEntry) bool {
+	if oldEntry.isDir != newEntry.isDir {
+		return false
+	}
+	if newEntry.meta.Inode != 0 && newEntry.meta.Inode != oldEntry.meta.Inode {
+		return false
+	}
+	if newEntry.isDir {
+		return newEntry.meta.Inode != 0
+	}
+	return oldEntry.meta.Unchanged(newEntry.meta)
+}
+
+// Returns the paths in the tree but not on disk, on disk but not in the tree,
+// and files whose size or modification time has changed, each in lexical order.
+// A path which has changed between being a file and a directory is both removed and added.
+func compareEntries(tree, disk map[string]pathEntry) (removed, added, written []string) {
+	for path, entry := range tree {
+		diskEntry, ok := disk[path]
+		if !ok || diskEntry.isDir != entry.isDir {
+			removed = append(removed, path)
+		} else if !entry.isDir && !entry.meta.Unchanged(diskEntry.meta) {
+			written = append(written, path)
+		}
+	}
+	for path, entry := range disk {
+		treeEntry, ok := tree[path]
+		if !ok || treeEntry.isDir != entry.isDir {
+			added = append(added, path)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	sort.Strings(written)
+	return
+}
+
+// Returns the paths whose parent is not among paths, in the same order
+func topLevel(paths []string) []string {
+	present := make(map[string]bool)
+	for _, path := range paths {
+		present[path] = true
+	}
+	var top []string
+	for _, path := range paths {
+		if !present[filepath.Dir(path)] {
+			top = append(top, path)
+		}
+	}
+	return top
+}
+
+// Returns the entries of dir and every path below it on disk, and the paths below dir
+// which could not be read. Only an error in reading dir itself is returned, so that
+// a single unreadable path, or one deleted while being walked, does not stop the poll.
+func scanEntries(dir string) (map[string]pathEntry, []string, error) {
+	entries := make(map[string]pathEntry)
+	var unreadable []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			if os.IsNotExist(err) {
+				// Deleted since its directory was read
+				return nil
+			}
+			log.Printf("Failed to poll %s: %s\n", path, err)
+			unreadable = append(unreadable, path)
+			if info == nil {
+				return nil
+			}
+		}
+		entries[path] = pathEntry{
+			isDir: info.IsDir(),
+			meta:  afs.MetadataFromFileInfo(path, info),
+		}
+		return nil
+	})
+	return entries, unreadable, err
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/alecthomas/assert"
+)
+
+func TestCompareEntries(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	file := func(size int64, mtime time.Time) pathEntry {
+		return pathEntry{meta: afs.Metadata{Size: size, ModTime: mtime}}
+	}
+	dir := pathEntry{isDir: true}
+
+	tree := map[string]pathEntry{
+		testPath("/root"):           dir,
+		testPath("/root/same"):      file(3, now),
+		testPath("/root/written"):   file(3, now),
+		testPath("/root/gone"):      dir,
+		testPath("/root/gone/file"): file(1, now),
+		testPath("/root/kind"):      file(1, now),
+	}
+	disk := map[string]pathEntry{
+		testPath("/root"):          dir,
+		testPath("/root/same"):     file(3, now),
+		testPath("/root/written"):  file(3, now.Add(time.Second)),
+		testPath("/root/kind"):     dir,
+		testPath("/root/new"):      dir,
+		testPath("/root/new/file"): file(1, now),
+	}
+
+	removed, added, written := compareEntries(tree, disk)
+	assert.Equal([]string{testPath("/root/gone"), testPath("/root/gone/file"), testPath("/root/kind")}, removed)
+	assert.Equal([]string{testPath("/root/kind"), testPath("/root/new"), testPath("/root/new/file")}, added)
+	assert.Equal([]string{testPath("/root/written")}, written)
+
+	assert.Equal([]string{testPath("/root/gone"), testPath("/root/kind")}, topLevel(removed))
+	assert.Equal([]string{testPath("/root/kind"), testPath("/root/new")}, topLevel(added))
+}
+
+func TestPollTree(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "piledriver-poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	write := func(name, contents string) {
+		err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("kept", "a")
+	write("moved", "b")
+	write("deleted", "c")
+
+	state := NewState()
+	err = state.AddPolledDir(root, time.Minute)
+	assert.NoError(err)
+
+	err = os.Rename(filepath.Join(root, "moved"), filepath.Join(root, "renamed"))
+	assert.NoError(err)
+	assert.NoError(os.Remove(filepath.Join(root, "deleted")))
+	write("created", "d")
+	write("kept", "changed")
+
+	pollDir(state, root)
+	close(state.FileEvents)
+	var events []string
+	for ev := range state.FileEvents {
+		events = append(events, ev.String())
+	}
+	assert.Equal([]string{
+		Event{OldPath: filepath.Join(root, "moved"), Path: filepath.Join(root, "renamed"), Category: FileRenamed}.String(),
+		Event{Path: filepath.Join(root, "deleted"), Category: FileDeleted}.String(),
+		Event{Path: filepath.Join(root, "created"), Category: FileCreated}.String(),
+		Event{Path: filepath.Join(root, "kept"), Category: FileWritten}.String(),
+	}, events)
+	assert.True(state.pathExists(filepath.Join(root, "renamed")))
+	assert.False(state.pathExists(filepath.Join(root, "deleted")))
+}
+
+func TestPollUnreadableDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permissions do not stop the directory from being read")
+	}
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "piledriver-poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	locked := filepath.Join(root, "locked")
+	assert.NoError(os.Mkdir(locked, 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(locked, "file"), []byte("a"), 0644))
+
+	state := NewState()
+	err = state.AddPolledDir(root, time.Minute)
+	assert.NoError(err)
+
+	assert.NoError(os.Chmod(locked, 0000))
+	defer os.Chmod(locked, 0755)
+	assert.NoError(ioutil.WriteFile(filepath.Join(root, "created"), []byte("b"), 0644))
+
+	// The rest of the directory is still polled, and the contents of locked are not deleted
+	pollDir(state, root)
+	close(state.FileEvents)
+	var events []string
+	for ev := range state.FileEvents {
+		events = append(events, ev.String())
+	}
+	assert.Equal([]string{
+		Event{Path: filepath.Join(root, "created"), Category: FileCreated}.String(),
+	}, events)
+	assert.True(state.pathExists(filepath.Join(locked, "file")))
+}
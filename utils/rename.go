@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"time"
+
+	"github.com/RedDocMD/piledriver/afs"
+)
+
+// fsnotify reports a rename as a Rename event for the old path, followed by
+// a Create event for the new path, but gives no way to correlate the two.
+// So a pending rename is paired with a Create of a path having the same inode
+// (or failing that, when either inode is unknown, the same size and modification time).
+// A rename which is not paired within renameTimeout is taken to be a move out
+// of the watched directories.
+
+const renameTimeout = time.Second
+
+type pendingRename struct {
+	path      string
+	isDir     bool
+	meta      afs.Metadata
+	timestamp time.Time
+}
+
+// Holds the renames whose new path has not been seen yet
+type renameTracker struct {
+	pending []pendingRename // In order of arrival
+}
+
+// Adds a rename, unless one is already pending for the same path
+// (which happens when a watched directory is renamed)
+func (tracker *renameTracker) add(rename pendingRename) {
+	for _, pending := range tracker.pending {
+		if pending.path == rename.path {
+			return
+		}
+	}
+	tracker.pending = append(tracker.pending, rename)
+}
+
+// Finds and removes the pending rename whose new path has metadata meta
+func (tracker *renameTracker) match(meta afs.Metadata) (pendingRename, bool) {
+	isDir := meta.Mode.IsDir()
+	matchers := []func(pending pendingRename) bool{
+		func(pending pendingRename) bool {
+			return meta.Inode != 0 && pending.meta.Inode == meta.Inode
+		},
+		func(pending pendingRename) bool {
+			// Differing inodes rule out a rename, however alike the files are
+			unknownInode := meta.Inode == 0 || pending.meta.Inode == 0
+			return !isDir && unknownInode && pending.meta.Unchanged(meta)
+		},
+	}
+	for _, matches := range matchers {
+		for i, pending := range tracker.pending {
+			if pending.isDir == isDir && matches(pending) {
+				return tracker.remove(i), true
+			}
+		}
+	}
+
+	// Without inodes to go by, a lone rename can only be paired with this
+	if meta.Inode == 0 {
+		idx := -1
+		for i, pending := range tracker.pending {
+			if pending.isDir == isDir {
+				if idx != -1 {
+					return pendingRename{}, false
+				}
+				idx = i
+			}
+		}
+		if idx != -1 {
+			return tracker.remove(idx), true
+		}
+	}
+	return pendingRename{}, false
+}
+
+// Removes and returns the renames which have been pending for longer than renameTimeout
+func (tracker *renameTracker) expire(now time.Time) []pendingRename {
+	var expired, remaining []pendingRename
+	for _, pending := range tracker.pending {
+		if now.Sub(pending.timestamp) >= renameTimeout {
+			expired = append(expired, pending)
+		} else {
+			remaining = append(remaining, pending)
+		}
+	}
+	tracker.pending = remaining
+	return expired
+}
+
+func (tracker *renameTracker) remove(idx int) pendingRename {
+	rename := tracker.pending[idx]
+	tracker.pending = append(tracker.pending[:idx], tracker.pending[idx+1:]...)
+	return rename
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/RedDocMD/piledriver/afs"
+	"github.com/alecthomas/assert"
+)
+
+func TestRenameTrackerMatchesByInode(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := &renameTracker{}
+	tracker.add(pendingRename{path: "/a", meta: afs.Metadata{Inode: 1, Size: 3}, timestamp: now})
+	tracker.add(pendingRename{path: "/b", meta: afs.Metadata{Inode: 2, Size: 3}, timestamp: now})
+	tracker.add(pendingRename{path: "/b", meta: afs.Metadata{Inode: 2, Size: 3}, timestamp: now})
+	assert.Equal(2, len(tracker.pending))
+
+	// An unrelated create must not be paired
+	_, ok := tracker.match(afs.Metadata{Inode: 3, Size: 3})
+	assert.False(ok)
+
+	rename, ok := tracker.match(afs.Metadata{Inode: 2, Size: 3})
+	assert.True(ok)
+	assert.Equal("/b", rename.path)
+	rename, ok = tracker.match(afs.Metadata{Inode: 1, Size: 3})
+	assert.True(ok)
+	assert.Equal("/a", rename.path)
+	assert.Equal(0, len(tracker.pending))
+}
+
+func TestRenameTrackerDifferentInodes(t *testing.T) {
+	now := time.Now()
+	tracker := &renameTracker{}
+	tracker.add(pendingRename{path: "/a", meta: afs.Metadata{Inode: 1, Size: 3, ModTime: now}, timestamp: now})
+
+	// A copy with the same size and modification time (eg, by cp -p) is not a rename
+	_, ok := tracker.match(afs.Metadata{Inode: 2, Size: 3, ModTime: now})
+	assert.False(t, ok)
+	assert.Equal(t, 1, len(tracker.pending))
+}
+
+func TestRenameTrackerWithoutInodes(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := &renameTracker{}
+	tracker.add(pendingRename{path: "/a", meta: afs.Metadata{Size: 3, ModTime: now}, timestamp: now})
+	tracker.add(pendingRename{path: "/b", meta: afs.Metadata{Size: 4, ModTime: now}, timestamp: now})
+	tracker.add(pendingRename{path: "/dir", isDir: true, timestamp: now})
+
+	rename, ok := tracker.match(afs.Metadata{Size: 4, ModTime: now})
+	assert.True(ok)
+	assert.Equal("/b", rename.path)
+	rename, ok = tracker.match(afs.Metadata{Mode: os.ModeDir})
+	assert.True(ok)
+	assert.Equal("/dir", rename.path)
+	rename, ok = tracker.match(afs.Metadata{Size: 5, ModTime: now})
+	assert.True(ok)
+	assert.Equal("/a", rename.path)
+}
+
+func TestRenameTrackerExpires(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+	tracker := &renameTracker{}
+	tracker.add(pendingRename{path: "/a", timestamp: now})
+	tracker.add(pendingRename{path: "/b", timestamp: now.Add(renameTimeout / 2)})
+
+	expired := tracker.expire(now.Add(renameTimeout))
+	assert.Equal(1, len(expired))
+	assert.Equal("/a", expired[0].path)
+	assert.Equal(1, len(tracker.pending))
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// ResolvePath returns the ID of the file at path, whose parts are separated by "/",
+// relative to the folder with ID rootID, or to the top of the drive if rootID is empty.
+// The empty path is the root folder. If the file is not found, the error is ErrNotFound.
+// The shared drive with the given ID is queried, or My Drive if driveID is empty.
+func ResolvePath(service *drive.Service, driveID, rootID, path string) (string, error) {
+	id := rootID
+	if id == "" {
+		id = topFolderID(driveID)
+	}
+	for _, name := range splitRemotePath(path) {
+		var err error
+		id, err = QueryFileID(service, driveID, id, name)
+		if err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// Returns the non-empty parts of path
+func splitRemotePath(path string) []string {
+	var parts []string
+	for _, part := range strings.Split(path, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
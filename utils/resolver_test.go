@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// Serves files.list for files, returning one file per page, and files.update of their appProperties
+// (with or without an upload of their contents)
+func fakeDrive(t *testing.T, files []*drive.File, requests *int) *drive.Service {
+	nameRe := regexp.MustCompile(`name = '([^']*)'`)
+	mimeTypeRe := regexp.MustCompile(`mimeType = '([^']*)'`)
+	parentRe := regexp.MustCompile(`'([^']*)' in parents`)
+	propRe := regexp.MustCompile(`appProperties has \{ key='([^']*)' and value='([^']*)' \}`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.Method == http.MethodPatch {
+			var update struct {
+				AppProperties map[string]*string `json:"appProperties"`
+			}
+			var media []byte
+			if mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/related" {
+				// The metadata is followed by the contents
+				parts := multipart.NewReader(r.Body, params["boundary"])
+				if part, err := parts.NextPart(); err == nil {
+					json.NewDecoder(part).Decode(&update)
+				}
+				if part, err := parts.NextPart(); err == nil {
+					media, _ = ioutil.ReadAll(part)
+				}
+			} else {
+				json.NewDecoder(r.Body).Decode(&update)
+			}
+			for _, file := range files {
+				if r.URL.Path == "/files/"+file.Id || r.URL.Path == "/upload/drive/v3/files/"+file.Id {
+					if file.AppProperties == nil {
+						file.AppProperties = make(map[string]string)
+					}
+					for key, value := range update.AppProperties {
+						if value == nil {
+							delete(file.AppProperties, key)
+						} else {
+							file.AppProperties[key] = *value
+						}
+					}
+					if media != nil {
+						file.Md5Checksum = fmt.Sprintf("%x", md5.Sum(media))
+					}
+					json.NewEncoder(w).Encode(file)
+					return
+				}
+			}
+			http.NotFound(w, r)
+			return
+		}
+
+		q := r.URL.Query().Get("q")
+		parents := make(map[string]bool)
+		for _, match := range parentRe.FindAllStringSubmatch(q, -1) {
+			parents[match[1]] = true
+		}
+		var matches []*drive.File
+	matching:
+		for _, file := range files {
+			if name := nameRe.FindStringSubmatch(q); name != nil && name[1] != file.Name {
+				continue
+			}
+			if mimeType := mimeTypeRe.FindStringSubmatch(q); mimeType != nil && mimeType[1] != file.MimeType {
+				continue
+			}
+			if len(parents) > 0 && !parents[file.Parents[0]] {
+				continue
+			}
+			for _, prop := range propRe.FindAllStringSubmatch(q, -1) {
+				if file.AppProperties[prop[1]] != prop[2] {
+					continue matching
+				}
+			}
+			matches = append(matches, file)
+		}
+
+		list := &drive.FileList{}
+		page, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+		if page < len(matches) {
+			list.Files = matches[page : page+1]
+		}
+		if page+1 < len(matches) {
+			list.NextPageToken = strconv.Itoa(page + 1)
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+	t.Cleanup(server.Close)
+
+	service, err := drive.NewService(context.Background(),
+		option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+var fakeFiles = []*drive.File{
+	{Id: "machine", Name: "piledriver-x", Parents: []string{"root"}, MimeType: folderMimeType},
+	{Id: "aoc", Name: "AOC", Parents: []string{"machine"}, MimeType: folderMimeType},
+	{Id: "src", Name: "src", Parents: []string{"aoc"}, MimeType: folderMimeType},
+	{Id: "main", Name: "main.go", Parents: []string{"src"}},
+	{Id: "readme", Name: "README", Parents: []string{"aoc"}},
+	{Id: "other-src", Name: "src", Parents: []string{"root"}, MimeType: folderMimeType},
+}
+
+func TestQueryDescendants(t *testing.T) {
+	requests := 0
+	service := fakeDrive(t, fakeFiles, &requests)
+
+	files, err := QueryDescendants(service, "", "aoc")
+	assert.NoError(t, err)
+	var ids []string
+	for _, file := range files {
+		ids = append(ids, file.Id)
+	}
+	// Every page is followed
+	assert.Equal(t, []string{"src", "readme", "main"}, ids)
+}
+
+func TestResolvePath(t *testing.T) {
+	assert := assert.New(t)
+	requests := 0
+	service := fakeDrive(t, fakeFiles, &requests)
+
+	id, err := ResolvePath(service, "", "", "piledriver-x/AOC/src")
+	assert.NoError(err)
+	assert.Equal("src", id)
+	assert.Equal(3, requests)
+
+	id, err = ResolvePath(service, "", "", "/piledriver-x/AOC/")
+	assert.NoError(err)
+	assert.Equal("aoc", id)
+
+	id, err = ResolvePath(service, "", "aoc", "src/main.go")
+	assert.NoError(err)
+	assert.Equal("main", id)
+
+	_, err = ResolvePath(service, "", "", "piledriver-x/missing")
+	assert.True(errors.Is(err, ErrNotFound))
+
+	id, err = ResolvePath(service, "", "", "")
+	assert.NoError(err)
+	assert.Equal("root", id)
+}
+
+func TestQuoteQuery(t *testing.T) {
+	assert.Equal(t, `'it\'s a \\ folder'`, quoteQuery(`it's a \ folder`))
+}
@@ -5,8 +5,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"time"
 
 	"github.com/RedDocMD/piledriver/afs"
 	"github.com/RedDocMD/piledriver/config"
@@ -14,16 +14,31 @@ import (
 	"google.golang.org/api/drive/v3"
 )
 
+// Remote is the Google account a directory is backed up to
+type Remote struct {
+	Account      string // Name of the account in the config (empty for the default account)
+	Service      *drive.Service
+	RootFolderID string // ID of the folder in Drive which holds the backed up directories
+	DriveID      string // ID of the shared drive backed up to (My Drive if empty)
+	MachineID    string // Identifier of this machine, which its folders in Drive are marked with
+}
+
 // State holds global state info for the program
 type State struct {
 	Config          config.Config
 	LogFilePath     string
 	FileEvents      chan Event
 	DebouncedEvents chan Event
+	Rescans         chan string // Root paths of trees to be rescanned
 	watcher         *fsnotify.Watcher
-	service         *drive.Service
-	trees           map[string]*afs.Tree // Map from root path to tree
+	remotes         map[string]*Remote       // Map from root path to the remote it is backed up to
+	trees           map[string]*afs.Tree     // Map from root path to tree
+	algo            afs.HashAlgorithm        // Used for the checksums of files in all trees
+	rescanPending   map[string]bool          // Root paths in Rescans
+	generations     map[string]uint64        // Map from root path to the number of times the tree has been rescanned
+	polled          map[string]time.Duration // Map from path to poll interval, for directories which are polled rather than watched
 	mu              sync.Mutex
+	eventsMu        sync.Mutex // Held while an event is being executed
 }
 
 // NewState returns a new blank state
@@ -31,14 +46,13 @@ func NewState() *State {
 	return &State{
 		FileEvents:      make(chan Event, 512),
 		DebouncedEvents: make(chan Event, 512),
+		Rescans:         make(chan string, 16),
+		remotes:         make(map[string]*Remote),
 		trees:           make(map[string]*afs.Tree),
-	}
-}
-
-// InitService initializes the service field
-func (state *State) InitService(tokenPath string) {
-	if state.service == nil {
-		state.service = GetDriveService(tokenPath)
+		algo:            afs.MD5,
+		rescanPending:   make(map[string]bool),
+		generations:     make(map[string]uint64),
+		polled:          make(map[string]time.Duration),
 	}
 }
 
@@ -53,18 +67,72 @@ func (state *State) InitWatcher() {
 	}
 }
 
-// Service returns the service field
-func (state *State) Service() *drive.Service {
-	return state.service
+// SetHashAlgorithm sets the algorithm used for checksums.
+// It must be called before any directories are added.
+func (state *State) SetHashAlgorithm(algo afs.HashAlgorithm) {
+	state.algo = algo
+}
+
+// SetRemote sets the remote that the directory dir is backed up to
+func (state *State) SetRemote(dir string, remote *Remote) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	state.remotes[filepath.Clean(dir)] = remote
+}
+
+// Remote returns the remote that path is backed up to.
+// If the directories of several remotes contain path, the innermost is chosen.
+func (state *State) Remote(path string) (*Remote, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var found *Remote
+	foundDir := ""
+	for dir, remote := range state.remotes {
+		if afs.IsSubPath(path, dir) && (found == nil || len(dir) > len(foundDir)) {
+			found, foundDir = remote, dir
+		}
+	}
+	return found, found != nil
 }
 
 // Tree returns the tree with the given name
 // If a tree with this name is found, then the boolean is true else false
 func (state *State) Tree(name string) (*afs.Tree, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
 	tree, ok := state.trees[name]
 	return tree, ok
 }
 
+// HashAlgorithm returns the algorithm used for checksums
+func (state *State) HashAlgorithm() afs.HashAlgorithm {
+	return state.algo
+}
+
+// PauseEvents waits for the event being executed, if any, to finish
+// and stops any more from being executed until ResumeEvents is called
+func (state *State) PauseEvents() {
+	state.eventsMu.Lock()
+}
+
+// ResumeEvents resumes the execution of events paused by PauseEvents
+func (state *State) ResumeEvents() {
+	state.eventsMu.Unlock()
+}
+
+// Adds dir and every path below it to tree
+func scanTree(tree *afs.Tree, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Print("Failed to scan - ", err)
+			return nil
+		}
+		tree.AddPath(path, info.IsDir())
+		tree.AttachMetadata(path, afs.MetadataFromFileInfo(path, info))
+		return nil
+	})
+}
+
 func (state *State) scanDir(dir string) error {
 	// Assume that dir has already been added to state.trees
 	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
@@ -73,62 +141,190 @@ func (state *State) scanDir(dir string) error {
 			return nil
 		}
 		for name := range state.trees {
-			if strings.HasPrefix(path, name) {
+			if afs.IsSubPath(path, name) {
 				state.trees[name].AddPath(path, info.IsDir())
+				state.trees[name].AttachMetadata(path, afs.MetadataFromFileInfo(path, info))
 			}
 		}
 		return nil
 	})
 }
 
-// AddDir adds a directory to the watcher and scans paths
+// Pushes ev to FileEvents, stamped with the generation of the tree containing its path
+func (state *State) pushEvent(ev Event) {
+	ev.Generation = state.generation(ev.Path)
+	state.FileEvents <- ev
+}
+
+// Returns the number of times the tree containing path has been rescanned
+func (state *State) generation(path string) uint64 {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	tree, ok := state.treeFor(path)
+	if !ok {
+		return 0
+	}
+	return state.generations[tree.RootPath()]
+}
+
+// RequestRescan queues a rescan of the tree containing path, unless one is already queued
+func (state *State) RequestRescan(path string) {
+	state.mu.Lock()
+	tree, ok := state.treeFor(path)
+	if !ok || state.rescanPending[tree.RootPath()] {
+		state.mu.Unlock()
+		return
+	}
+	root := tree.RootPath()
+	state.rescanPending[root] = true
+	state.mu.Unlock()
+	log.Printf("Rescan of %s requested\n", root)
+	select {
+	case state.Rescans <- root:
+	default:
+		// The caller may be executing an event, which the rescan must wait for, so it must not block
+		go func() { state.Rescans <- root }()
+	}
+}
+
+// RequestRescanAll queues a rescan of all trees
+func (state *State) RequestRescanAll() {
+	state.mu.Lock()
+	roots := make([]string, 0, len(state.trees))
+	for root := range state.trees {
+		roots = append(roots, root)
+	}
+	state.mu.Unlock()
+	for _, root := range roots {
+		state.RequestRescan(root)
+	}
+}
+
+// Rescan scans the directory at root into a new tree, and passes it to reconcile
+// to make Drive consistent with it. Only once that succeeds does the new tree
+// replace the old one, and the events pushed until then become stale.
+// state.mu is held throughout, so that the watchers wait rather than change
+// the trees while reconcile walks the new one.
+// Further rescans of root may be queued once this is called.
+func (state *State) Rescan(root string, reconcile func(tree *afs.Tree) error) error {
+	state.mu.Lock()
+	delete(state.rescanPending, root)
+	if _, ok := state.trees[root]; !ok {
+		state.mu.Unlock()
+		return errors.New("No tree rooted at " + root)
+	}
+	tree := afs.NewTree(root)
+	tree.SetHashAlgorithm(state.algo)
+	err := scanTree(tree, root)
+	if err == nil {
+		err = reconcile(tree)
+	}
+	if err == nil {
+		state.trees[root] = tree
+		state.generations[root]++
+	}
+	state.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Directories created while events were being dropped are not watched yet
+	return state.watchDir(root)
+}
+
+// AddDir adds a directory to the watcher and scans paths.
+// The watches are added first, so that no path created meanwhile is missed.
 func (state *State) AddDir(dir string) error {
+	if err := state.watchDir(dir); err != nil {
+		return err
+	}
+	return state.addDir(dir)
+}
+
+// AddPolledDir adds a directory which is polled every interval by PollLoop,
+// instead of being watched, and scans paths.
+// This is for filesystems which do not report changes, such as network filesystems.
+func (state *State) AddPolledDir(dir string, interval time.Duration) error {
+	state.mu.Lock()
+	state.polled[filepath.Clean(dir)] = interval
+	state.mu.Unlock()
+	return state.addDir(dir)
+}
+
+func (state *State) addDir(dir string) error {
 	state.mu.Lock()
 	added := false
 	for name := range state.trees {
-		if strings.HasPrefix(dir, name) {
+		if afs.IsSubPath(dir, name) {
 			state.trees[name].AddPath(dir, true)
 			added = true
 		}
 	}
 	if !added {
 		tree := afs.NewTree(dir)
+		tree.SetHashAlgorithm(state.algo)
 		state.trees[tree.RootPath()] = tree
 	}
 	err := state.scanDir(dir)
 	state.mu.Unlock()
-	if err != nil {
-		return err
+	return err
+}
+
+// Adds watches on dir and all directories below it, unless it is in a polled directory
+func (state *State) watchDir(dir string) error {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.watchDirLocked(dir)
+}
+
+// Same as watchDir, but must be called with state.mu held.
+// Subtrees which cannot be watched, since the limit on watches has been reached, are polled instead.
+func (state *State) watchDirLocked(dir string) error {
+	if state.isPolled(dir) {
+		return nil
+	}
+	unwatched, err := addDirRecursive(dir, state.watcher)
+	for _, path := range unwatched {
+		log.Printf("Out of watches, polling %s instead\n", path)
+		state.polled[path] = DefaultPollInterval
 	}
-	return addDirRecursive(dir, state.watcher)
+	return err
+}
+
+// Returns whether path is in a polled directory.
+// Must be called with state.mu held.
+func (state *State) isPolled(path string) bool {
+	for dir := range state.polled {
+		if afs.IsSubPath(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stops polling dir, if it was being polled
+func (state *State) stopPolling(dir string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	delete(state.polled, dir)
 }
 
 // isDir checks a path if it is a directory
 func (state *State) isDir(path string) (bool, error) {
 	state.mu.Lock()
 	defer state.mu.Unlock()
-	for name := range state.trees {
-		if strings.HasPrefix(path, name) {
-			stat, err := state.trees[name].IsDir(path)
-			if err != nil {
-				return false, err
-			}
-			return stat, nil
-		}
+	if tree, ok := state.treeFor(path); ok {
+		return tree.IsDir(path)
 	}
 	return false, errors.New("Path not found in any tree: " + path)
 }
 
-// Adds a file and returns whether it was actually added
-func (state *State) addFile(path string) bool {
+// Adds a path and returns whether it was actually added
+func (state *State) addPath(path string, isDir bool) bool {
 	state.mu.Lock()
 	defer state.mu.Unlock()
 	// Assume parent directory has been added before
-	for name := range state.trees {
-		if strings.HasPrefix(path, name) {
-			done := state.trees[name].AddPath(path, false)
-			return done
-		}
+	if tree, ok := state.treeFor(path); ok {
+		return tree.AddPath(path, isDir)
 	}
 	return false
 }
@@ -136,29 +332,55 @@ func (state *State) addFile(path string) bool {
 func (state *State) delPath(path string) bool {
 	state.mu.Lock()
 	defer state.mu.Unlock()
-	for name := range state.trees {
-		if strings.HasPrefix(path, name) {
-			done := state.trees[name].DeletePath(path)
-			return done
-		}
+	if tree, ok := state.treeFor(path); ok {
+		return tree.DeletePath(path)
 	}
 	return false
 }
 
+// Renames oldPath to newPath, which may be in different trees
 func (state *State) renamePath(oldPath, newPath string) bool {
 	state.mu.Lock()
 	defer state.mu.Unlock()
+	oldTree, ok := state.treeFor(oldPath)
+	if !ok {
+		return false
+	}
+	newTree, ok := state.treeFor(newPath)
+	if !ok {
+		return false
+	}
+	isDir, _ := oldTree.IsDir(oldPath)
+
+	var done bool
+	if oldTree == newTree {
+		done = oldTree.RenamePath(oldPath, newPath)
+	} else if node, ok := oldTree.DetachPath(oldPath); ok {
+		done = newTree.AttachNode(newPath, node)
+		if !done {
+			oldTree.AttachNode(oldPath, node)
+		}
+	}
+	if done && isDir {
+		// Re-adding the watches makes fsnotify report the new paths
+		if err := state.watchDirLocked(newPath); err != nil {
+			log.Printf("Failed to watch %s: %s\n", newPath, err)
+		}
+	}
+	return done
+}
+
+// Returns the tree which path belongs to.
+// If the roots of several trees contain path, the innermost is chosen.
+// Must be called with state.mu held.
+func (state *State) treeFor(path string) (*afs.Tree, bool) {
+	var found *afs.Tree
 	for name, tree := range state.trees {
-		if strings.HasPrefix(oldPath, name) {
-			isDir, _ := tree.IsDir(oldPath)
-			done := tree.RenamePath(oldPath, newPath)
-			if isDir {
-				state.watcher.Add(newPath)
-			}
-			return done
+		if afs.IsSubPath(path, name) && (found == nil || len(name) > len(found.RootPath())) {
+			found = tree
 		}
 	}
-	return false
+	return found, found != nil
 }
 
 func (state *State) pathExists(path string) bool {
@@ -183,6 +405,47 @@ func (state *State) attachID(path, id string) bool {
 	return false
 }
 
+// Reads the metadata of path from the OS and attaches it to the tree
+func (state *State) refreshMetadata(path string) bool {
+	meta, err := afs.ReadMetadata(path)
+	if err != nil {
+		return false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, tree := range state.trees {
+		if tree.AttachMetadata(path, meta) {
+			return true
+		}
+	}
+	return false
+}
+
+func (state *State) metadata(path string) (afs.Metadata, bool) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, tree := range state.trees {
+		meta, err := tree.RetrieveMetadata(path)
+		if err == nil {
+			return meta, true
+		}
+	}
+	return afs.Metadata{}, false
+}
+
+// Removes the watches on dir and all directories below it
+func (state *State) unwatchDir(dir string) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for _, tree := range state.trees {
+		tree.Walk(dir, func(path string, node *afs.Node) {
+			if node.IsDir() {
+				state.watcher.Remove(path)
+			}
+		})
+	}
+}
+
 func (state *State) retrieveID(path string) (string, bool) {
 	state.mu.Lock()
 	defer state.mu.Unlock()
@@ -194,3 +457,40 @@ func (state *State) retrieveID(path string) (string, bool) {
 	}
 	return "", false
 }
+
+// Returns the poll interval of each polled directory, by path
+func (state *State) polledDirs() map[string]time.Duration {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	dirs := make(map[string]time.Duration)
+	for dir, interval := range state.polled {
+		dirs[dir] = interval
+	}
+	return dirs
+}
+
+// Returns path and every path below it in the tree, parents before their children
+func (state *State) subtreePaths(path string) []string {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	var paths []string
+	if tree, ok := state.treeFor(path); ok {
+		tree.Walk(path, func(path string, node *afs.Node) {
+			paths = append(paths, path)
+		})
+	}
+	return paths
+}
+
+// Returns the entries of dir and every path below it in the tree
+func (state *State) treeEntries(dir string) map[string]pathEntry {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	entries := make(map[string]pathEntry)
+	if tree, ok := state.treeFor(dir); ok {
+		tree.Walk(dir, func(path string, node *afs.Node) {
+			entries[path] = pathEntry{isDir: node.IsDir(), meta: node.Metadata()}
+		})
+	}
+	return entries
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Interval at which the token file is checked while waiting for re-authentication
+const reauthPollInterval = 10 * time.Second
+
+// A token source which saves refreshed tokens to the token file.
+// When the refresh token is no longer accepted (eg, it has been revoked), it waits
+// for "piledriver auth" to write a new token file, which pauses everything
+// that uses Drive in the meantime.
+type savingTokenSource struct {
+	ctx          context.Context
+	conf         *oauth2.Config
+	store        *tokenStore
+	pollInterval time.Duration
+	mu           sync.Mutex
+	base         oauth2.TokenSource
+	saved        *oauth2.Token // Last token loaded from or saved to store
+}
+
+func newSavingTokenSource(ctx context.Context, conf *oauth2.Config, tok *oauth2.Token, store *tokenStore) *savingTokenSource {
+	return &savingTokenSource{
+		ctx:          ctx,
+		conf:         conf,
+		store:        store,
+		pollInterval: reauthPollInterval,
+		base:         conf.TokenSource(ctx, tok),
+		saved:        tok,
+	}
+}
+
+// Token returns a valid token, refreshing it if necessary
+func (ts *savingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for {
+		tok, err := ts.base.Token()
+		if err == nil {
+			if tok.AccessToken != ts.saved.AccessToken {
+				if err := ts.store.save(tok); err != nil {
+					log.Printf("Failed to save refreshed token: %s\n", err)
+				}
+				ts.saved = tok
+			}
+			return tok, nil
+		}
+		if !isAuthError(err) {
+			return nil, err
+		}
+		ts.waitForReauth(err)
+	}
+}
+
+// Forces the token to be refreshed the next time it is used
+func (ts *savingTokenSource) invalidate() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	expired := *ts.saved
+	expired.Expiry = time.Now().Add(-time.Minute)
+	ts.base = ts.conf.TokenSource(ts.ctx, &expired)
+}
+
+// Waits until a new token has been written to the token file.
+// Must be called with ts.mu held.
+func (ts *savingTokenSource) waitForReauth(cause error) {
+	log.Printf("Piledriver needs to be re-authenticated (%s): please run \"piledriver auth\". "+
+		"Syncing is paused until then.\n", cause)
+	var lastMod time.Time
+	if info, err := os.Stat(ts.store.path); err == nil {
+		lastMod = info.ModTime()
+	}
+	for {
+		time.Sleep(ts.pollInterval)
+		info, err := os.Stat(ts.store.path)
+		if err != nil || !info.ModTime().After(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+		tok, err := ts.store.load()
+		if err != nil {
+			continue
+		}
+		log.Println("Re-authenticated, resuming sync")
+		ts.base = ts.conf.TokenSource(ts.ctx, tok)
+		ts.saved = tok
+		return
+	}
+}
+
+// Returns an HTTP client which authorizes requests with tokens from ts
+func (ts *savingTokenSource) client() *http.Client {
+	return &http.Client{
+		Transport: &reauthTransport{
+			base:   &oauth2.Transport{Source: ts, Base: http.DefaultTransport},
+			source: ts,
+		},
+	}
+}
+
+// Invalidates the token when Drive rejects it, so that the next request refreshes it
+// (and finds out if re-authentication is needed)
+type reauthTransport struct {
+	base   http.RoundTripper
+	source *savingTokenSource
+}
+
+func (t *reauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.source.invalidate()
+	}
+	return resp, err
+}
+
+// Returns whether err means that the refresh token is no longer accepted
+func isAuthError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	if retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusUnauthorized {
+		return true
+	}
+	return strings.Contains(string(retrieveErr.Body), "invalid_grant")
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/RedDocMD/piledriver/config"
+	"github.com/RedDocMD/piledriver/fileutil"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/oauth2"
+)
+
+// Parameters of PBKDF2, which derives the key that encrypts the token.
+// Token files with fewer iterations or a salt of another size are rejected.
+const (
+	kdfIterations = 310000
+	saltSize      = 16
+)
+
+// Reads and writes the token file, which is encrypted with AES-GCM if secret is set.
+// The key is derived from secret (a passphrase, or the contents of a key file) with PBKDF2.
+type tokenStore struct {
+	path   string
+	secret []byte
+}
+
+// Format of an encrypted token file
+type encryptedToken struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Returns the store of the token file given by auth.
+// If auth.EncryptToken is set, the secret is read from auth.TokenKeyPath, or else it is auth.Passphrase.
+func newTokenStore(auth config.AuthConfig) (*tokenStore, error) {
+	store := &tokenStore{path: auth.TokenPath}
+	if !auth.EncryptToken {
+		return store, nil
+	}
+	if auth.TokenKeyPath != "" {
+		key, err := ioutil.ReadFile(auth.TokenKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		store.secret = key
+	} else {
+		store.secret = []byte(auth.Passphrase)
+	}
+	if len(store.secret) == 0 {
+		return nil, errors.New("the token is encrypted, but no passphrase or key file was given")
+	}
+	return store, nil
+}
+
+// Returns the store of the token file given by auth, exiting if it cannot be
+func mustTokenStore(auth config.AuthConfig) *tokenStore {
+	store, err := newTokenStore(auth)
+	if err != nil {
+		log.Fatalf("Cannot access token: %s\n", err)
+	}
+	return store
+}
+
+// Reads the token. A plaintext token is accepted even if the store is encrypted,
+// and is encrypted right away.
+func (store *tokenStore) load() (*oauth2.Token, error) {
+	data, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return nil, err
+	}
+	var enc encryptedToken
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return nil, err
+	}
+	if enc.Ciphertext != nil {
+		if store.secret == nil {
+			return nil, errors.New("the token is encrypted, but encryptToken is not set")
+		}
+		if enc.KDF != "pbkdf2-sha256" {
+			return nil, fmt.Errorf("unknown key derivation function: %s", enc.KDF)
+		}
+		if enc.Iterations < kdfIterations {
+			return nil, fmt.Errorf("too few key derivation iterations: %d", enc.Iterations)
+		}
+		if len(enc.Salt) != saltSize {
+			return nil, fmt.Errorf("key derivation salt has %d bytes instead of %d", len(enc.Salt), saltSize)
+		}
+		gcm, err := newGCM(store.secret, enc.Salt, enc.Iterations)
+		if err != nil {
+			return nil, err
+		}
+		data, err = gcm.Open(nil, enc.Nonce, enc.Ciphertext, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s, the passphrase or key file of its account is wrong", store.path)
+		}
+	}
+	tok := &oauth2.Token{}
+	if err = json.Unmarshal(data, tok); err != nil {
+		return nil, err
+	}
+	if enc.Ciphertext == nil && store.secret != nil {
+		log.Println("Encrypting the plaintext token")
+		if err := store.save(tok); err != nil {
+			log.Printf("Failed to encrypt the token: %s\n", err)
+		}
+	}
+	return tok, nil
+}
+
+// Writes the token atomically, encrypting it if the store is encrypted
+func (store *tokenStore) save(tok *oauth2.Token) error {
+	data, err := json.Marshal(tok)
+	if err != nil {
+		return err
+	}
+	if store.secret != nil {
+		enc := encryptedToken{
+			KDF:        "pbkdf2-sha256",
+			Iterations: kdfIterations,
+			Salt:       make([]byte, saltSize),
+		}
+		if _, err := rand.Read(enc.Salt); err != nil {
+			return err
+		}
+		gcm, err := newGCM(store.secret, enc.Salt, enc.Iterations)
+		if err != nil {
+			return err
+		}
+		enc.Nonce = make([]byte, gcm.NonceSize())
+		if _, err := rand.Read(enc.Nonce); err != nil {
+			return err
+		}
+		enc.Ciphertext = gcm.Seal(nil, enc.Nonce, data, nil)
+		if data, err = json.Marshal(enc); err != nil {
+			return err
+		}
+	}
+	return fileutil.WriteFileAtomic(store.path, data, 0600)
+}
+
+// Returns AES-256-GCM with the key derived from secret
+func newGCM(secret, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key(secret, salt, iterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
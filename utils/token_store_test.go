@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/RedDocMD/piledriver/config"
+	"github.com/alecthomas/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestEncryptedTokenStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}
+
+	// A plaintext token is encrypted when loaded
+	assert.NoError((&tokenStore{path: path}).save(tok))
+	store, err := newTokenStore(config.AuthConfig{TokenPath: path, EncryptToken: true, Passphrase: "secret"})
+	assert.NoError(err)
+	loaded, err := store.load()
+	assert.NoError(err)
+	assert.Equal("refresh", loaded.RefreshToken)
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.False(strings.Contains(string(data), "refresh"))
+
+	loaded, err = store.load()
+	assert.NoError(err)
+	assert.Equal("refresh", loaded.RefreshToken)
+
+	wrong, err := newTokenStore(config.AuthConfig{TokenPath: path, EncryptToken: true, Passphrase: "wrong"})
+	assert.NoError(err)
+	_, err = wrong.load()
+	assert.Error(err)
+	_, err = (&tokenStore{path: path}).load()
+	assert.Error(err)
+
+	_, err = newTokenStore(config.AuthConfig{TokenPath: path, EncryptToken: true})
+	assert.Error(err)
+}
+
+func TestTokenStoreRejectsWeakKDF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "piledriver-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	store := &tokenStore{path: path, secret: []byte("secret")}
+	assert.NoError(t, store.save(&oauth2.Token{RefreshToken: "refresh"}))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	for name, tamper := range map[string]func(*encryptedToken){
+		"iterations": func(enc *encryptedToken) { enc.Iterations = 1 },
+		"empty salt": func(enc *encryptedToken) { enc.Salt = nil },
+		"short salt": func(enc *encryptedToken) { enc.Salt = enc.Salt[:8] },
+	} {
+		var enc encryptedToken
+		assert.NoError(t, json.Unmarshal(data, &enc))
+		tamper(&enc)
+		tampered, err := json.Marshal(enc)
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(path, tampered, 0600))
+		_, err = store.load()
+		assert.Error(t, err, name)
+	}
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/RedDocMD/piledriver/config"
+	"github.com/alecthomas/assert"
+	"golang.org/x/oauth2"
+)
+
+type fakeTokenSource struct {
+	tok *oauth2.Token
+	err error
+}
+
+func (ts *fakeTokenSource) Token() (*oauth2.Token, error) {
+	return ts.tok, ts.err
+}
+
+func TestSavingTokenSource(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "piledriver-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+
+	old := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh"}
+	store := &tokenStore{path: path}
+	assert.NoError(store.save(old))
+	ts := newSavingTokenSource(context.Background(), mustOAuthConfig(config.AuthConfig{}, ""), old, store)
+
+	// A refreshed token is saved
+	refreshed := &oauth2.Token{AccessToken: "new", RefreshToken: "refresh", Expiry: time.Now().Add(time.Hour)}
+	ts.base = &fakeTokenSource{tok: refreshed}
+	tok, err := ts.Token()
+	assert.NoError(err)
+	assert.Equal("new", tok.AccessToken)
+	saved, err := store.load()
+	assert.NoError(err)
+	assert.Equal("new", saved.AccessToken)
+
+	// A revoked token waits for a new token file
+	ts.pollInterval = 10 * time.Millisecond
+	ts.base = &fakeTokenSource{err: &oauth2.RetrieveError{
+		Response: &http.Response{StatusCode: http.StatusBadRequest},
+		Body:     []byte(`{"error": "invalid_grant"}`),
+	}}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		reauthed := &oauth2.Token{AccessToken: "reauthed", RefreshToken: "other", Expiry: time.Now().Add(time.Hour)}
+		store.save(reauthed)
+		// Make sure the modification time moves on, however coarse it is
+		os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	}()
+	tok, err = ts.Token()
+	assert.NoError(err)
+	assert.Equal("reauthed", tok.AccessToken)
+}
+
+func TestIsAuthError(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(isAuthError(&oauth2.RetrieveError{
+		Response: &http.Response{StatusCode: http.StatusBadRequest},
+		Body:     []byte(`{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`),
+	}))
+	assert.True(isAuthError(&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}))
+	assert.False(isAuthError(&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusInternalServerError}}))
+	assert.False(isAuthError(os.ErrNotExist))
+}
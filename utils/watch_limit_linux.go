@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MaxWatches returns the maximum number of watches a user may have,
+// if there is such a limit
+func MaxWatches() (int, bool) {
+	data, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_user_watches")
+	if err != nil {
+		return 0, false
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, false
+	}
+	return max, true
+}
+
+// inotify_add_watch fails with ENOSPC once max_user_watches is reached
+func isWatchLimitError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+// MaxWatches returns the maximum number of watches a user may have,
+// if there is such a limit
+func MaxWatches() (int, bool) {
+	return 0, false
+}
+
+func isWatchLimitError(err error) bool {
+	return false
+}
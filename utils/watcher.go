@@ -1,11 +1,13 @@
 package utils
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/RedDocMD/piledriver/afs"
 	"github.com/fsnotify/fsnotify"
 )
 
@@ -13,10 +15,9 @@ import (
 // recursive causes it to add new directories being created
 func WatchLoop(state *State) {
 	watcher := state.watcher
-	events := state.FileEvents
-
-	renamePending := false
-	pathToBeRenamed := ""
+	renames := &renameTracker{}
+	ticker := time.NewTicker(renameTimeout / 4)
+	defer ticker.Stop()
 
 	for {
 		select {
@@ -25,120 +26,246 @@ func WatchLoop(state *State) {
 				log.Println("exiting from watch loop")
 				return
 			}
-
-			path := event.Name
-			var category EventCategory
-			pushEvent := true
-
-			idMap := make(map[IDKey]string)
-			timestamp := time.Now()
-
-			var isDir bool
-			var err error
-			if !renamePending {
-				isDir, err = state.isDir(path)
-				if err != nil {
-					stat, err := os.Stat(path)
-					if os.IsNotExist(err) {
-						log.Println("Failed to open:", path)
-					} else {
-						isDir = stat.IsDir()
-					}
-				}
-			} else {
-				isDir, err = state.isDir(pathToBeRenamed)
-				if err != nil {
-					pushEvent = false
-				}
-			}
-
-			switch event.Op {
-			case fsnotify.Create:
-				if renamePending {
-					if ok := state.renamePath(pathToBeRenamed, path); !ok {
-						log.Printf("Cannot rename %s to %s", pathToBeRenamed, path)
-						pushEvent = false
-					}
-					if isDir {
-						category = DirectoryRenamed
-					} else {
-						category = FileRenamed
-					}
-					renamePending = false
-				} else {
-					if isDir {
-						err := state.AddDir(path)
-						if err != nil {
-							log.Println("Failed to add", path, "to tree")
-						}
-						category = DirectoryCreated
-					} else {
-						ok := state.addFile(path)
-						if !ok {
-							log.Println("Failed to add", path, "to tree")
-						}
-						category = FileCreated
-					}
-				}
-			case fsnotify.Remove:
-				if isDir {
-					category = DirectoryDeleted
-				} else {
-					category = FileDeleted
-				}
-				id, ok := state.retrieveID(path)
-				if !ok {
-					log.Printf("Cannot retrieve ID of %s\n", path)
-					pushEvent = false
-				} else {
-					idMap[CurrID] = id
-					if ok := state.delPath(path); !ok {
-						log.Println("Cannot delete: ", path)
-						pushEvent = false
-					}
-				}
-			case fsnotify.Write:
-				category = FileWritten
-			case fsnotify.Rename:
-				pushEvent = false
-				if state.pathExists(path) {
-					renamePending = true
-					pathToBeRenamed = path
+			handleWatchEvent(state, renames, event)
+		case now := <-ticker.C:
+			for _, rename := range renames.expire(now) {
+				// Moved out of the watched directories
+				if rename.isDir {
+					state.unwatchDir(rename.path)
 				}
-			default:
-				pushEvent = false
+				removePath(state, rename.path, rename.isDir, now)
 			}
-
-			if pushEvent {
-				events <- Event{
-					Path:      path,
-					OldPath:   pathToBeRenamed,
-					Category:  category,
-					IDMap:     idMap,
-					Timestamp: timestamp,
-				}
-			}
-		case event, ok := <-watcher.Errors:
+		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
 			}
-			log.Println("Watcher error: ", event)
+			log.Println("Watcher error: ", err)
+			handleWatchError(state, err)
+		}
+	}
+}
+
+// Handles each operation in the mask of event, as several may be combined
+func handleWatchEvent(state *State, renames *renameTracker, event fsnotify.Event) {
+	path := event.Name
+	timestamp := time.Now()
+
+	if event.Op&fsnotify.Create != 0 {
+		handleCreate(state, renames, path, timestamp)
+	}
+	if event.Op&fsnotify.Write != 0 {
+		pushWrite(state, path, timestamp)
+	}
+	if event.Op&fsnotify.Chmod != 0 {
+		handleChmod(state, path, timestamp)
+	}
+	if event.Op&fsnotify.Rename != 0 {
+		isDir, err := state.isDir(path)
+		if err == nil {
+			meta, _ := state.metadata(path)
+			renames.add(pendingRename{
+				path:      path,
+				isDir:     isDir,
+				meta:      meta,
+				timestamp: timestamp,
+			})
+		}
+	}
+	if event.Op&fsnotify.Remove != 0 {
+		isDir, err := state.isDir(path)
+		if err != nil {
+			log.Printf("Cannot find %s in tree\n", path)
+			return
+		}
+		removePath(state, path, isDir, timestamp)
+	}
+}
+
+func handleCreate(state *State, renames *renameTracker, path string, timestamp time.Time) {
+	meta, err := afs.ReadMetadata(path)
+	if err != nil {
+		log.Println("Failed to open:", path)
+		return
+	}
+	isDir := meta.Mode.IsDir()
+	if rename, ok := renames.match(meta); ok {
+		if fileIsDir, err := state.isDir(path); err == nil && !fileIsDir && !isDir {
+			// Renamed over an existing file, as editors do to save atomically.
+			// So the existing file is updated, rather than replaced, to keep its Drive ID.
+			removePath(state, rename.path, false, timestamp)
+			pushWrite(state, path, timestamp)
+			return
+		}
+		renamePath(state, rename.path, path, isDir, timestamp)
+		return
+	}
+
+	// Moved in from outside the watched directories, or newly created
+	createPath(state, path, isDir, timestamp)
+}
+
+// Adds path to the tree, and pushes create events for it and anything below it
+func createPath(state *State, path string, isDir bool, timestamp time.Time) {
+	if !isDir {
+		ok := state.addPath(path, false)
+		if !ok {
+			log.Println("Failed to add", path, "to tree")
+		}
+		state.refreshMetadata(path)
+		pushCreate(state, path, FileCreated, timestamp)
+		return
+	}
+	err := state.AddDir(path)
+	if err != nil {
+		log.Println("Failed to add", path, "to tree")
+	}
+	// The directory may already have contents (eg, when copied or extracted),
+	// which must be created along with it
+	for _, subPath := range state.subtreePaths(path) {
+		category := FileCreated
+		if subIsDir, _ := state.isDir(subPath); subIsDir {
+			category = DirectoryCreated
 		}
+		pushCreate(state, subPath, category, timestamp)
+	}
+}
+
+// Pushes an event to update the metadata of path, if its permissions or
+// modification time have changed (eg, by chmod or touch).
+// Other changes of attributes, such as of owner, are not tracked.
+func handleChmod(state *State, path string, timestamp time.Time) {
+	meta, err := afs.ReadMetadata(path)
+	if err != nil {
+		return
+	}
+	old, ok := state.metadata(path)
+	if !ok || (old.Mode == meta.Mode && old.ModTime.Equal(meta.ModTime)) {
+		return
+	}
+	state.refreshMetadata(path)
+	state.pushEvent(Event{
+		Path:      path,
+		Category:  MetadataChanged,
+		IDMap:     make(map[IDKey]string),
+		Timestamp: timestamp,
+	})
+}
+
+// Events may have been missed after an error, so the affected trees
+// are rescanned (all of them, unless the error names a path)
+func handleWatchError(state *State, err error) {
+	var pathErr *os.PathError
+	if err != fsnotify.ErrEventOverflow && errors.As(err, &pathErr) && state.pathExists(pathErr.Path) {
+		state.RequestRescan(pathErr.Path)
+		return
+	}
+	state.RequestRescanAll()
+}
+
+// Renames oldPath to newPath in the tree and pushes an event to rename it in Drive
+func renamePath(state *State, oldPath, newPath string, isDir bool, timestamp time.Time) {
+	oldRemote, _ := state.Remote(oldPath)
+	newRemote, _ := state.Remote(newPath)
+	if oldRemote != newRemote {
+		// Files cannot be moved between accounts in Drive, so they are uploaded again
+		removePath(state, oldPath, isDir, timestamp)
+		createPath(state, newPath, isDir, timestamp)
+		return
+	}
+	if ok := state.renamePath(oldPath, newPath); !ok {
+		log.Printf("Cannot rename %s to %s", oldPath, newPath)
+		return
+	}
+	category := FileRenamed
+	if isDir {
+		category = DirectoryRenamed
+	}
+	state.pushEvent(Event{
+		Path:      newPath,
+		OldPath:   oldPath,
+		Category:  category,
+		IDMap:     make(map[IDKey]string),
+		Timestamp: timestamp,
+	})
+}
+
+// Pushes an event to create path in Drive
+func pushCreate(state *State, path string, category EventCategory, timestamp time.Time) {
+	state.pushEvent(Event{
+		Path:      path,
+		Category:  category,
+		IDMap:     make(map[IDKey]string),
+		Timestamp: timestamp,
+	})
+}
+
+// Pushes an event to upload the new contents of path
+func pushWrite(state *State, path string, timestamp time.Time) {
+	state.refreshMetadata(path)
+	state.pushEvent(Event{
+		Path:      path,
+		Category:  FileWritten,
+		IDMap:     make(map[IDKey]string),
+		Timestamp: timestamp,
+	})
+}
+
+// Removes path from the tree and pushes an event to delete it from Drive
+func removePath(state *State, path string, isDir bool, timestamp time.Time) {
+	category := FileDeleted
+	if isDir {
+		category = DirectoryDeleted
+	}
+	id, ok := state.retrieveID(path)
+	if !ok {
+		log.Printf("Cannot retrieve ID of %s\n", path)
+		return
 	}
+	if ok := state.delPath(path); !ok {
+		log.Println("Cannot delete: ", path)
+		return
+	}
+	state.pushEvent(Event{
+		Path:      path,
+		Category:  category,
+		IDMap:     map[IDKey]string{CurrID: id},
+		Timestamp: timestamp,
+	})
 }
 
-func addDirRecursive(dir string, watcher *fsnotify.Watcher) error {
-	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+// Adds watches on dir and all directories below it.
+// Once the limit on watches is reached, the subtrees which could not be watched
+// are returned instead of an error.
+func addDirRecursive(dir string, watcher *fsnotify.Watcher) ([]string, error) {
+	var unwatched []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Print("Failed to add - ", err)
 			return err
 		}
 		if info.IsDir() {
 			err := watcher.Add(path)
+			if isWatchLimitError(err) {
+				unwatched = append(unwatched, path)
+				return filepath.SkipDir
+			}
 			if err != nil {
 				return err
 			}
 		}
 		return nil
 	})
+	return unwatched, err
+}
+
+// CountWatches returns the number of watches needed for dir, ie, the number of directories in it
+func CountWatches(dir string) int {
+	count := 0
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			count++
+		}
+		return nil
+	})
+	return count
 }
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestCreatedDirectoryWithContents(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "piledriver-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	state := NewState()
+	state.InitWatcher()
+	defer state.watcher.Close()
+	assert.NoError(state.AddDir(root))
+
+	dir := filepath.Join(root, "dir")
+	assert.NoError(os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "sub", "file"), nil, 0644))
+
+	handleWatchEvent(state, &renameTracker{}, fsnotify.Event{Name: dir, Op: fsnotify.Create})
+	close(state.FileEvents)
+	var events []string
+	for ev := range state.FileEvents {
+		events = append(events, ev.String())
+	}
+	assert.Equal([]string{
+		Event{Path: dir, Category: DirectoryCreated}.String(),
+		Event{Path: filepath.Join(dir, "file"), Category: FileCreated}.String(),
+		Event{Path: filepath.Join(dir, "sub"), Category: DirectoryCreated}.String(),
+		Event{Path: filepath.Join(dir, "sub", "file"), Category: FileCreated}.String(),
+	}, events)
+}
+
+func TestCountWatches(t *testing.T) {
+	root, err := ioutil.TempDir("", "piledriver-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "a", "b"), 0755))
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "c"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "a", "file"), nil, 0644))
+	assert.Equal(t, 4, CountWatches(root))
+}
+
+func TestCombinedOpsAndChmod(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "piledriver-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	state := NewState()
+	state.InitWatcher()
+	defer state.watcher.Close()
+	assert.NoError(state.AddDir(root))
+
+	file := filepath.Join(root, "file")
+	assert.NoError(ioutil.WriteFile(file, []byte("contents"), 0644))
+	handleWatchEvent(state, &renameTracker{}, fsnotify.Event{Name: file, Op: fsnotify.Create | fsnotify.Write})
+	// The mode is unchanged
+	handleWatchEvent(state, &renameTracker{}, fsnotify.Event{Name: file, Op: fsnotify.Chmod})
+	assert.NoError(os.Chmod(file, 0600))
+	handleWatchEvent(state, &renameTracker{}, fsnotify.Event{Name: file, Op: fsnotify.Chmod})
+
+	close(state.FileEvents)
+	var events []string
+	for ev := range state.FileEvents {
+		events = append(events, ev.String())
+	}
+	assert.Equal([]string{
+		Event{Path: file, Category: FileCreated}.String(),
+		Event{Path: file, Category: FileWritten}.String(),
+		Event{Path: file, Category: MetadataChanged}.String(),
+	}, events)
+}
+
+func TestRenameBetweenAccounts(t *testing.T) {
+	assert := assert.New(t)
+	root, err := ioutil.TempDir("", "piledriver-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	work, personal := filepath.Join(root, "work"), filepath.Join(root, "personal")
+	assert.NoError(os.Mkdir(work, 0755))
+	assert.NoError(os.MkdirAll(filepath.Join(personal, "dir"), 0755))
+	assert.NoError(ioutil.WriteFile(filepath.Join(personal, "dir", "file"), nil, 0644))
+
+	state := NewState()
+	state.InitWatcher()
+	defer state.watcher.Close()
+	assert.NoError(state.AddDir(work))
+	assert.NoError(state.AddDir(personal))
+	state.SetRemote(work, &Remote{Account: "work"})
+	state.SetRemote(personal, &Remote{})
+
+	oldDir, newDir := filepath.Join(personal, "dir"), filepath.Join(work, "dir")
+	assert.NoError(os.Rename(oldDir, newDir))
+	renamePath(state, oldDir, newDir, true, time.Now())
+	close(state.FileEvents)
+	var events []string
+	for ev := range state.FileEvents {
+		events = append(events, ev.String())
+	}
+	assert.Equal([]string{
+		Event{Path: oldDir, Category: DirectoryDeleted}.String(),
+		Event{Path: newDir, Category: DirectoryCreated}.String(),
+		Event{Path: filepath.Join(newDir, "file"), Category: FileCreated}.String(),
+	}, events)
+	assert.False(state.pathExists(oldDir))
+}